@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"ft_0/server"
+	"os"
+	"os/signal"
+)
+
+const usage = `usage:
+  ft_0                         start the terminal UI
+  ft_0 send [-name NAME] -     send standard input
+  ft_0 send PATH...            send files or folders
+  ft_0 send -to CODE PATH...   answer a file request
+  ft_0 receive CODE -          write the received file to standard output
+  ft_0 receive CODE [DIR]      save received files into DIR
+  ft_0 request [-|DIR]         ask someone to send you files
+`
+
+// Run handles the non-interactive commands and returns the process exit code.
+// Status lines go to stderr so stdout stays free for piped data.
+func Run(args []string) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	switch args[0] {
+	case "send":
+		err = send(ctx, args[1:])
+	case "receive":
+		err = receive(ctx, args[1:])
+	case "request":
+		err = request(ctx, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ft_0:", err)
+		return 1
+	}
+	return 0
+}
+
+func send(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	name := flags.String("name", "stdin", "file name offered for standard input")
+	to := flags.String("to", "", "request code to answer")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("nothing to send")
+	}
+
+	progressChan := make(chan server.SendProgress)
+	if *to != "" {
+		server.StartRequestSender(*to, flags.Args(), nil, progressChan, ctx)
+	} else if flags.NArg() == 1 && flags.Arg(0) == "-" {
+		server.StartStreamSender(*name, os.Stdin, nil, progressChan, ctx)
+	} else {
+		server.StartSender(flags.Args(), nil, progressChan, ctx)
+	}
+
+	var last server.SendProgress
+	code := *to
+	for p := range progressChan {
+		if p.State == server.StateWaitingForReceiver && p.Code != code {
+			code = p.Code
+			fmt.Fprintf(os.Stderr, "Code: %s\n", code)
+		}
+		last = p
+	}
+	return finalError(last.State, last.Error)
+}
+
+func receive(ctx context.Context, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("missing code")
+	}
+
+	conn, err := server.StartReceiver(args[0])
+	if err != nil {
+		return err
+	}
+	return receiveFrom(ctx, conn, args[1:])
+}
+
+func request(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("too many arguments")
+	}
+
+	req, err := server.CreateRequest(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Code: %s\n", req.Code)
+
+	conn, err := req.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return receiveFrom(ctx, conn, args)
+}
+
+// receiveFrom accepts the offer on conn into args' destination: standard
+// output for "-", the named folder, or the configured download folder.
+func receiveFrom(ctx context.Context, conn *server.ReceiverConn, args []string) error {
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	progressChan := make(chan server.ReceiveProgress)
+	if len(args) == 1 && args[0] == "-" {
+		server.ReceiveStream(conn, meta, os.Stdout, nil, progressChan, ctx)
+	} else {
+		config := server.LoadConfig()
+		dir := config.DownloadDir
+		if len(args) == 1 {
+			dir = args[0]
+		}
+		server.ReceiveFile(conn, meta, dir, server.Conflicts{Policy: config.ConflictPolicy}, nil, progressChan, ctx)
+	}
+
+	var last server.ReceiveProgress
+	for p := range progressChan {
+		last = p
+	}
+	if last.State == server.StateCompleted {
+		fmt.Fprintf(os.Stderr, "Received %s (%d bytes)\n", meta.Name, last.BytesReceived)
+	}
+	return finalError(last.State, last.Error)
+}
+
+func finalError(state server.TransferState, err error) error {
+	switch {
+	case state == server.StateCompleted:
+		return nil
+	case err != nil:
+		return err
+	case state == server.StateCancelled:
+		return errors.New("transfer cancelled")
+	default:
+		return errors.New("transfer did not complete")
+	}
+}
@@ -6,10 +6,18 @@ import (
 
 	tea "github.com/charmbracelet/bubbletea"
 
+	"ft_0/cli"
+	"ft_0/server"
 	"ft_0/ui"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(cli.Run(os.Args[1:]))
+	}
+
+	go server.CleanStaleParts(server.LoadConfig().DownloadDir)
+
 	model := ui.InitialModel()
 	p := tea.NewProgram(&model, tea.WithAltScreen())
 	if _, err := p.Run(); err != nil {
@@ -0,0 +1,88 @@
+package pake
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+
+	"github.com/gtank/ristretto255"
+)
+
+const (
+	dsi       = "CPaceRistretto255"
+	ShareSize = 32
+)
+
+var ErrInvalidShare = errors.New("invalid key exchange share")
+
+// CPace runs one side of a CPace exchange over ristretto255. Both peers
+// derive the generator from the shared password, so only a peer that knows
+// the password computes the same key.
+type CPace struct {
+	initiator bool
+	sessionID []byte
+	scalar    *ristretto255.Scalar
+	share     []byte
+}
+
+func New(password, sessionID string, initiator bool) (*CPace, error) {
+	generator := ristretto255.NewElement().FromUniformBytes(
+		hash(dsi, password, sessionID),
+	)
+
+	random := make([]byte, 64)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	scalar := ristretto255.NewScalar().FromUniformBytes(random)
+
+	share := ristretto255.NewElement().ScalarMult(scalar, generator)
+
+	return &CPace{
+		initiator: initiator,
+		sessionID: []byte(sessionID),
+		scalar:    scalar,
+		share:     share.Encode(nil),
+	}, nil
+}
+
+func (c *CPace) Share() []byte {
+	return c.share
+}
+
+func (c *CPace) Finish(peerShare []byte) ([]byte, error) {
+	if len(peerShare) != ShareSize {
+		return nil, ErrInvalidShare
+	}
+
+	peer := ristretto255.NewElement()
+	if err := peer.Decode(peerShare); err != nil {
+		return nil, ErrInvalidShare
+	}
+
+	shared := ristretto255.NewElement().ScalarMult(c.scalar, peer)
+	if shared.Equal(ristretto255.NewElement().Zero()) == 1 {
+		return nil, ErrInvalidShare
+	}
+
+	initiatorShare, responderShare := c.share, peerShare
+	if !c.initiator {
+		initiatorShare, responderShare = peerShare, c.share
+	}
+
+	key := hash(dsi+"_ISK", string(c.sessionID), string(shared.Encode(nil)),
+		string(initiatorShare), string(responderShare))
+	return key, nil
+}
+
+func hash(parts ...string) []byte {
+	h := sha512.New()
+	var length [8]byte
+	for _, part := range parts {
+		binary.BigEndian.PutUint64(length[:], uint64(len(part)))
+		h.Write(length[:])
+		h.Write([]byte(part))
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize    = 5
+	MaxFrameSize  = 1 << 20
+	sealOverhead  = 1 + 16
+	maxWireLength = MaxFrameSize + sealOverhead
+)
+
+type Frame struct {
+	Type    MessageType
+	Payload []byte
+}
+
+func (f Frame) Decode(v any) error {
+	if err := json.Unmarshal(f.Payload, v); err != nil {
+		return fmt.Errorf("invalid %s message: %v", f.Type, err)
+	}
+	return nil
+}
+
+type Conn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	writeMu      sync.Mutex
+	header       [headerSize]byte
+	sendSealer   *sealer
+	recvSealer   *sealer
+	Peer         Hello
+	Streams      int
+	capabilities []string
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn:   conn,
+		reader: bufio.NewReaderSize(conn, 64*1024),
+	}
+}
+
+func (c *Conn) WriteFrame(t MessageType, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", len(payload))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.sendSealer != nil {
+		payload = c.sendSealer.seal(t, payload)
+		t = MsgSealed
+	}
+
+	var header [headerSize]byte
+	header[0] = byte(t)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	buffers := net.Buffers{header[:], payload}
+	_, err := buffers.WriteTo(c.conn)
+	return err
+}
+
+func (c *Conn) Send(t MessageType, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s message: %v", t, err)
+	}
+	return c.WriteFrame(t, payload)
+}
+
+func (c *Conn) ReadFrame() (Frame, error) {
+	if _, err := io.ReadFull(c.reader, c.header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(c.header[1:])
+	if length > maxWireLength {
+		return Frame{}, fmt.Errorf("frame too large: %d bytes", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	frame := Frame{Type: MessageType(c.header[0]), Payload: payload}
+	if c.recvSealer == nil {
+		return frame, nil
+	}
+	if frame.Type != MsgSealed {
+		return Frame{}, ErrAuthFailed
+	}
+	return c.recvSealer.open(frame.Payload)
+}
+
+// Handshake exchanges hello messages. Streams is read as the number of
+// parallel streams this side accepts and replaced by the negotiated count.
+func (c *Conn) Handshake(capabilities []string) error {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.Send(MsgHello, Hello{Version: Version, Capabilities: capabilities, Streams: c.Streams})
+	}()
+
+	frame, err := c.ReadFrame()
+	sendErr := <-sent
+	if err != nil {
+		return fmt.Errorf("failed to read hello: %w", err)
+	}
+	if sendErr != nil {
+		return fmt.Errorf("failed to send hello: %v", sendErr)
+	}
+	if frame.Type != MsgHello {
+		return fmt.Errorf("unexpected %s message during handshake", frame.Type)
+	}
+
+	var peer Hello
+	if err := frame.Decode(&peer); err != nil {
+		return err
+	}
+	if err := checkVersion(peer.Version); err != nil {
+		return err
+	}
+
+	c.Peer = peer
+	c.Streams = max(min(c.Streams, peer.Streams), 1)
+	c.capabilities = nil
+	for _, capability := range capabilities {
+		if slices.Contains(peer.Capabilities, capability) {
+			c.capabilities = append(c.capabilities, capability)
+		}
+	}
+	return nil
+}
+
+func checkVersion(version int) error {
+	if version != Version {
+		return fmt.Errorf("%w %d (expected %d)", ErrIncompatibleVersion, version, Version)
+	}
+	return nil
+}
+
+func (c *Conn) Supports(capability string) bool {
+	return slices.Contains(c.capabilities, capability)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
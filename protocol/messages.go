@@ -0,0 +1,158 @@
+package protocol
+
+import "fmt"
+
+const Version = 1
+
+const (
+	CapSHA256 = "sha256"
+	CapResume = "resume"
+	CapZstd   = "zstd"
+	CapGzip   = "gzip"
+	CapSkip   = "skip"
+	CapStream = "stream"
+)
+
+type MessageType byte
+
+const (
+	MsgHello MessageType = iota + 1
+	MsgOffer
+	MsgAccept
+	MsgReject
+	MsgData
+	MsgDone
+	MsgError
+	MsgCancel
+	MsgKeyExchange
+	MsgSealed
+	MsgFileStart
+	MsgFileDone
+	MsgCompressed
+	MsgStreamOpen
+	MsgStreamJoin
+	MsgRange
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgHello:
+		return "hello"
+	case MsgOffer:
+		return "offer"
+	case MsgAccept:
+		return "accept"
+	case MsgReject:
+		return "reject"
+	case MsgData:
+		return "data"
+	case MsgDone:
+		return "done"
+	case MsgError:
+		return "error"
+	case MsgCancel:
+		return "cancel"
+	case MsgKeyExchange:
+		return "key exchange"
+	case MsgSealed:
+		return "sealed"
+	case MsgFileStart:
+		return "file start"
+	case MsgFileDone:
+		return "file done"
+	case MsgCompressed:
+		return "compressed data"
+	case MsgStreamOpen:
+		return "stream open"
+	case MsgStreamJoin:
+		return "stream join"
+	case MsgRange:
+		return "range"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(t))
+	}
+}
+
+type Hello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Streams      int      `json:"streams,omitempty"`
+}
+
+type FileEntry struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode,omitempty"`
+	Dir     bool   `json:"dir,omitempty"`
+	ModTime int64  `json:"mod_time,omitempty"`
+	Head    string `json:"head,omitempty"`
+	Stream  bool   `json:"stream,omitempty"`
+	Text    bool   `json:"text,omitempty"`
+}
+
+type Offer struct {
+	Files []FileEntry `json:"files"`
+	More  bool        `json:"more,omitempty"`
+}
+
+type FileAccept struct {
+	Offset int64  `json:"offset,omitempty"`
+	Skip   bool   `json:"skip,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+type Accept struct {
+	Files      []FileAccept `json:"files"`
+	More       bool         `json:"more,omitempty"`
+	Sequential bool         `json:"sequential,omitempty"`
+}
+
+type Reject struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type FileStart struct {
+	Index       int    `json:"index"`
+	Compression string `json:"compression,omitempty"`
+	Streams     int    `json:"streams,omitempty"`
+	Restart     bool   `json:"restart,omitempty"`
+}
+
+type StreamOpen struct {
+	Token string `json:"token"`
+	Count int    `json:"count"`
+}
+
+type StreamJoin struct {
+	Token string `json:"token"`
+}
+
+type Range struct {
+	Index  int   `json:"index"`
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	End    bool  `json:"end,omitempty"`
+}
+
+type FileDone struct {
+	Index    int    `json:"index"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+type FileResult struct {
+	Index   int    `json:"index"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type Done struct {
+	Results []FileResult `json:"results,omitempty"`
+}
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type Cancel struct{}
@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ft_0/pake"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrAuthFailed          = errors.New("could not authenticate peer")
+	ErrIncompatibleVersion = errors.New("unsupported protocol version")
+)
+
+// KeyExchange is the first frame each side sends. It carries the protocol
+// version, since a peer speaking another version would otherwise only show
+// up as a frame that fails to decrypt.
+type KeyExchange struct {
+	Version int    `json:"version"`
+	Share   []byte `json:"share"`
+}
+
+type sealer struct {
+	aead    cipher.AEAD
+	counter uint64
+	nonce   [chacha20poly1305.NonceSize]byte
+}
+
+func newSealer(secret []byte, label string) (*sealer, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(label)), key); err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+func (s *sealer) next() []byte {
+	binary.BigEndian.PutUint64(s.nonce[4:], s.counter)
+	s.counter++
+	return s.nonce[:]
+}
+
+func (s *sealer) seal(t MessageType, payload []byte) []byte {
+	plain := make([]byte, 1+len(payload), 1+len(payload)+s.aead.Overhead())
+	plain[0] = byte(t)
+	copy(plain[1:], payload)
+	return s.aead.Seal(plain[:0], s.next(), plain, nil)
+}
+
+func (s *sealer) open(ciphertext []byte) (Frame, error) {
+	plain, err := s.aead.Open(ciphertext[:0], s.next(), ciphertext, nil)
+	if err != nil || len(plain) == 0 {
+		return Frame{}, ErrAuthFailed
+	}
+	return Frame{Type: MessageType(plain[0]), Payload: plain[1:]}, nil
+}
+
+// Secure runs a CPace exchange keyed by the shared code and encrypts every
+// later frame in both directions. A peer with a different code derives
+// different keys, which surfaces as ErrAuthFailed on the first frame read.
+func (c *Conn) Secure(code, sessionID string, initiator bool) error {
+	exchange, err := pake.New(code, sessionID, initiator)
+	if err != nil {
+		return fmt.Errorf("failed to start key exchange: %v", err)
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.Send(MsgKeyExchange, KeyExchange{Version: Version, Share: exchange.Share()})
+	}()
+
+	frame, err := c.ReadFrame()
+	sendErr := <-sent
+	if err != nil {
+		return fmt.Errorf("failed to read key exchange: %w", err)
+	}
+	if sendErr != nil {
+		return fmt.Errorf("failed to send key exchange: %v", sendErr)
+	}
+	if frame.Type != MsgKeyExchange {
+		return fmt.Errorf("unexpected %s message during key exchange", frame.Type)
+	}
+
+	var peer KeyExchange
+	if err := frame.Decode(&peer); err != nil {
+		return err
+	}
+	if err := checkVersion(peer.Version); err != nil {
+		return err
+	}
+
+	secret, err := exchange.Finish(peer.Share)
+	if err != nil {
+		return ErrAuthFailed
+	}
+
+	sendLabel, recvLabel := "ft_0 receiver to sender", "ft_0 sender to receiver"
+	if !initiator {
+		sendLabel, recvLabel = recvLabel, sendLabel
+	}
+
+	if c.sendSealer, err = newSealer(secret, sendLabel); err != nil {
+		return err
+	}
+	if c.recvSealer, err = newSealer(secret, recvLabel); err != nil {
+		return err
+	}
+	return nil
+}
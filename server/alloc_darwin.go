@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves blocks for the rest of the file past what it already
+// holds, without changing its size. A contiguous run is tried first, then any
+// free blocks.
+func preallocate(file *os.File, size int64) error {
+	info, err := file.Stat()
+	if err != nil || size <= info.Size() {
+		return nil
+	}
+
+	store := unix.Fstore_t{
+		Flags:   unix.F_ALLOCATECONTIG | unix.F_ALLOCATEALL,
+		Posmode: unix.F_PEOFPOSMODE,
+		Length:  size - info.Size(),
+	}
+	err = unix.FcntlFstore(file.Fd(), unix.F_PREALLOCATE, &store)
+	if err != nil {
+		store.Flags = unix.F_ALLOCATEALL
+		err = unix.FcntlFstore(file.Fd(), unix.F_PREALLOCATE, &store)
+	}
+	if errors.Is(err, unix.ENOSPC) {
+		return err
+	}
+	return nil
+}
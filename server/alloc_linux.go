@@ -0,0 +1,21 @@
+package server
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves blocks for the whole file without changing its size, so
+// the partial length still says how much has been received.
+func preallocate(file *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if errors.Is(err, unix.ENOSPC) {
+		return err
+	}
+	return nil
+}
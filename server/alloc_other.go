@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package server
+
+import "os"
+
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileAllocationInfo is FILE_ALLOCATION_INFO.
+type fileAllocationInfo struct {
+	AllocationSize int64
+}
+
+// preallocate reserves clusters for the whole file without moving its end,
+// so the partial length still says how much has been received.
+func preallocate(file *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	info := fileAllocationInfo{AllocationSize: size}
+	err := windows.SetFileInformationByHandle(windows.Handle(file.Fd()), windows.FileAllocationInfo, (*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL) {
+		return err
+	}
+	return nil
+}
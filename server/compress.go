@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"ft_0/protocol"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	entropySampleSize = 16 * 1024
+	entropyThreshold  = 7.5
+)
+
+var compressedExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".br": true, ".bz2": true,
+	".docx": true, ".flac": true, ".gif": true, ".gz": true, ".heic": true,
+	".jar": true, ".jpeg": true, ".jpg": true, ".lz4": true, ".m4a": true,
+	".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".ogg": true,
+	".png": true, ".pptx": true, ".rar": true, ".tgz": true, ".webm": true,
+	".webp": true, ".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+var compressionPreference = []string{protocol.CapZstd, protocol.CapGzip}
+
+type compressor interface {
+	compress(dst, src []byte) ([]byte, error)
+	decompress(src []byte) ([]byte, error)
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (c *zstdCompressor) compress(dst, src []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(src, dst), nil
+}
+
+func (c *zstdCompressor) decompress(src []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(src, nil)
+}
+
+type gzipCompressor struct {
+	buffer bytes.Buffer
+	writer *gzip.Writer
+}
+
+func (c *gzipCompressor) compress(dst, src []byte) ([]byte, error) {
+	c.buffer.Reset()
+	c.writer.Reset(&c.buffer)
+	if _, err := c.writer.Write(src); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+	return append(dst, c.buffer.Bytes()...), nil
+}
+
+func (c *gzipCompressor) decompress(src []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, protocol.MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > protocol.MaxFrameSize {
+		return nil, fmt.Errorf("compressed chunk expands beyond %d bytes", protocol.MaxFrameSize)
+	}
+	return data, nil
+}
+
+func newCompressor(name string) (compressor, error) {
+	switch name {
+	case protocol.CapZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(protocol.MaxFrameSize))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCompressor{encoder: encoder, decoder: decoder}, nil
+	case protocol.CapGzip:
+		return &gzipCompressor{writer: gzip.NewWriter(nil)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", name)
+	}
+}
+
+func negotiateCompression(conn *protocol.Conn) string {
+	for _, name := range compressionPreference {
+		if conn.Supports(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+func worthCompressing(name string, sample []byte) bool {
+	if compressedExtensions[strings.ToLower(filepath.Ext(name))] {
+		return false
+	}
+	return len(sample) == 0 || entropy(sample) < entropyThreshold
+}
+
+func entropy(sample []byte) float64 {
+	var counts [256]int
+	for _, c := range sample {
+		counts[c]++
+	}
+
+	var bits float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(sample))
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
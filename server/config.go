@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+type Config struct {
+	DownloadDir    string         `json:"download_dir,omitempty"`
+	ConflictPolicy ConflictPolicy `json:"conflict_policy,omitempty"`
+}
+
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ft_0", "config.json"), nil
+}
+
+func LoadConfig() Config {
+	var config Config
+	path, err := configPath()
+	if err != nil {
+		return config
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config
+	}
+	json.Unmarshal(data, &config)
+	return config
+}
+
+func SaveConfig(config Config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"ft_0/protocol"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func (c Conflicts) policy(index int) ConflictPolicy {
+	if policy, ok := c.Files[index]; ok {
+		return policy
+	}
+	if c.Policy == "" {
+		return ConflictRename
+	}
+	return c.Policy
+}
+
+func FindConflicts(m FileMetadata, dir string) []int {
+	if dir == "" {
+		dir = "."
+	}
+
+	var conflicts []int
+	for i, f := range m.Files {
+		if f.Dir {
+			continue
+		}
+		name, err := destinationPath(dir, f.Name)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Lstat(name); err == nil {
+			conflicts = append(conflicts, i)
+		}
+	}
+	return conflicts
+}
+
+func availableName(name string) string {
+	ext := filepath.Ext(name)
+	if inner := filepath.Ext(strings.TrimSuffix(name, ext)); strings.EqualFold(inner, ".tar") {
+		ext = inner + ext
+	}
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// existingPrefix reports whether a file already at the destination looks like
+// the start of entry, and returns the SHA-256 of all of it for the sender to
+// check against its own file before anything is sent. Only files covering the
+// whole head window can be checked, anything shorter is treated as unrelated.
+func existingPrefix(name string, entry protocol.FileEntry) (int64, string, bool) {
+	info, err := os.Lstat(name)
+	if err != nil || !info.Mode().IsRegular() || entry.Head == "" ||
+		info.Size() > entry.Size || info.Size() < min(entry.Size, headSize) {
+		return 0, "", false
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, "", false
+	}
+	defer file.Close()
+
+	head, err := headHash(file, entry.Size)
+	if err != nil || head != entry.Head {
+		return 0, "", false
+	}
+
+	h := sha256.New()
+	if n, err := io.Copy(h, file); err != nil || n != info.Size() {
+		return 0, "", false
+	}
+	return info.Size(), hex.EncodeToString(h.Sum(nil)), true
+}
+
+func restoreExisting(name string, size int64) {
+	if err := os.Truncate(partPath(name), size); err == nil {
+		os.Rename(partPath(name), name)
+	}
+	os.Remove(sidecarPath(name))
+}
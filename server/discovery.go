@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	discoveryProtocol = "ft0"
+	discoveryWait     = 750 * time.Millisecond
+	discoveryInterval = 250 * time.Millisecond
+	browseInterval    = time.Second
+)
+
+// Nearby is a sender serving a session on the local network.
+type Nearby struct {
+	SessionID string   `json:"session_id"`
+	Host      string   `json:"host"`
+	Addrs     []string `json:"addrs"`
+	Port      string   `json:"port"`
+	QUICPort  string   `json:"quic_port,omitempty"`
+}
+
+// discoveryQuery is broadcast on the discovery port to find senders: the
+// one serving Session, or every one when it is empty.
+type discoveryQuery struct {
+	Protocol string `json:"protocol"`
+	Session  string `json:"session"`
+}
+
+// advertise answers discovery queries for the session behind endpoint until
+// the listener is closed. Every sender on a machine binds the same port, so
+// all of them hear a broadcast query.
+func (l *transferListener) advertise(endpoint TransferSession) {
+	lc := net.ListenConfig{Control: reuseAddr}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", ":"+DISCOVERY_PORT)
+	if err != nil {
+		return
+	}
+
+	host, _ := os.Hostname()
+	reply, err := json.Marshal(Nearby{
+		SessionID: endpoint.SessionID,
+		Host:      host,
+		Addrs:     endpoint.SenderAddrs,
+		Port:      endpoint.SenderPort,
+		QUICPort:  endpoint.QUICPort,
+	})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go func() {
+		<-l.closed
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var query discoveryQuery
+			if json.Unmarshal(buf[:n], &query) != nil || query.Protocol != discoveryProtocol {
+				continue
+			}
+			if query.Session == "" || query.Session == endpoint.SessionID {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+}
+
+// Browse looks for senders on the local network until ctx ends, delivering
+// each answer as it arrives. Senders answer again every time they are asked,
+// so one that stops showing up has gone away.
+func Browse(ctx context.Context) (<-chan Nearby, error) {
+	found := make(chan Nearby)
+	sock, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+
+	port := DISCOVERY_PORT
+	go func() {
+		defer close(found)
+		discover(ctx, sock, port, "", browseInterval, func(n Nearby) bool {
+			select {
+			case found <- n:
+			case <-ctx.Done():
+			}
+			return true
+		})
+	}()
+	return found, nil
+}
+
+// findNearby asks the local network for the sender serving sessionID.
+func findNearby(sessionID string) (*Nearby, bool) {
+	sock, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryWait)
+	defer cancel()
+
+	var nearby *Nearby
+	discover(ctx, sock, DISCOVERY_PORT, sessionID, discoveryInterval, func(n Nearby) bool {
+		if n.SessionID != sessionID {
+			return true
+		}
+		nearby = &n
+		return false
+	})
+	return nearby, nearby != nil
+}
+
+// discover broadcasts queries for sessionID to port from sock every interval
+// and hands answers to found until it returns false or ctx ends. It closes
+// sock.
+func discover(ctx context.Context, sock net.PacketConn, port, sessionID string, interval time.Duration, found func(Nearby) bool) {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		sock.Close()
+	}()
+
+	query, err := json.Marshal(discoveryQuery{Protocol: discoveryProtocol, Session: sessionID})
+	if err != nil {
+		return
+	}
+	targets := broadcastAddrs(port)
+	ask := func() {
+		for _, target := range targets {
+			sock.WriteTo(query, target)
+		}
+	}
+
+	answers := make(chan Nearby)
+	go func() {
+		defer close(answers)
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := sock.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var nearby Nearby
+			if json.Unmarshal(buf[:n], &nearby) != nil || nearby.SessionID == "" {
+				continue
+			}
+			// The address the answer came from is the one known to reach us.
+			if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+				nearby.Addrs = slices.DeleteFunc(nearby.Addrs, func(a string) bool { return a == host })
+				nearby.Addrs = append([]string{host}, nearby.Addrs...)
+			}
+			select {
+			case answers <- nearby:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	ask()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case nearby, ok := <-answers:
+			if !ok || !found(nearby) {
+				return
+			}
+		case <-ticker.C:
+			ask()
+		}
+	}
+}
+
+// broadcastAddrs lists where discovery queries go: every IPv4 network this
+// machine is on, and loopback for senders on the same machine.
+func broadcastAddrs(port string) []net.Addr {
+	targets := []string{"127.255.255.255", "255.255.255.255"}
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ip, mask := ipNet.IP.To4(), net.IP(ipNet.Mask).To4()
+			if mask == nil {
+				continue
+			}
+			broadcast := make(net.IP, 4)
+			for i := range broadcast {
+				broadcast[i] = ip[i] | ^mask[i]
+			}
+			if !slices.Contains(targets, broadcast.String()) {
+				targets = append(targets, broadcast.String())
+			}
+		}
+	}
+
+	var resolved []net.Addr
+	for _, target := range targets {
+		if addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(target, port)); err == nil {
+			resolved = append(resolved, addr)
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	maxThrottleSleep = 100 * time.Millisecond
+	speedInterval    = 500 * time.Millisecond
+)
+
+var (
+	globalMu      sync.Mutex
+	globalLimiter *Limiter
+)
+
+// Limiter is a token bucket in bytes per second. Its rate can be changed while
+// transfers run; zero means unlimited.
+type Limiter struct {
+	mu     sync.Mutex
+	clock  Clock
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// Clock is what a Limiter reads the time from and waits on.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func NewLimiter(rate int64) *Limiter {
+	return NewLimiterClock(rate, systemClock{})
+}
+
+// NewLimiterClock returns a Limiter that runs on clock, so tests can drive
+// it without waiting.
+func NewLimiterClock(rate int64, clock Clock) *Limiter {
+	return &Limiter{clock: clock, rate: rate, last: clock.Now()}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(l.clock.Now())
+	l.rate = rate
+	l.tokens = max(min(l.tokens, l.burst()), 0)
+}
+
+// Wait blocks until the bucket is out of debt and then takes n tokens, so a
+// chunk larger than the bucket is paid off before the next one goes out.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		now := l.clock.Now()
+		l.refill(now)
+		if l.rate <= 0 || l.tokens >= 0 {
+			if l.rate > 0 {
+				l.tokens -= float64(n)
+			}
+			l.mu.Unlock()
+			return nil
+		}
+		// Rounded up, so a debt too small to show as a duration still ends.
+		delay := min(time.Duration(math.Ceil(-l.tokens/float64(l.rate)*float64(time.Second))), maxThrottleSleep)
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.clock.After(delay):
+		}
+	}
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), l.burst())
+	}
+	l.last = now
+}
+
+func (l *Limiter) burst() float64 {
+	return max(float64(l.rate)/4, float64(CHUNK_SIZE))
+}
+
+// global returns the limiter shared by all transfers. It is built from
+// RATE_LIMIT the first time a transfer needs it and follows the setting when
+// it changes afterwards.
+func global() *Limiter {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	if globalLimiter == nil {
+		globalLimiter = NewLimiter(RATE_LIMIT)
+	} else if globalLimiter.Rate() != RATE_LIMIT {
+		globalLimiter.SetRate(RATE_LIMIT)
+	}
+	return globalLimiter
+}
+
+func GlobalRateLimit() int64 {
+	return global().Rate()
+}
+
+func SetGlobalRateLimit(rate int64) {
+	globalMu.Lock()
+	RATE_LIMIT = rate
+	globalMu.Unlock()
+	global()
+}
+
+func throttle(ctx context.Context, limiter *Limiter, n int) error {
+	if limiter != nil {
+		if err := limiter.Wait(ctx, n); err != nil {
+			return errCancelled
+		}
+	}
+	if err := global().Wait(ctx, n); err != nil {
+		return errCancelled
+	}
+	return nil
+}
+
+type rateMeter struct {
+	start     time.Time
+	bytes     int64
+	wire      int64
+	speed     float64
+	wireSpeed float64
+}
+
+func newRateMeter() rateMeter {
+	return rateMeter{start: time.Now()}
+}
+
+func (m *rateMeter) add(logical, wire int) (float64, float64) {
+	m.bytes += int64(logical)
+	m.wire += int64(wire)
+
+	elapsed := time.Since(m.start)
+	if elapsed < speedInterval && m.speed > 0 {
+		return m.speed, m.wireSpeed
+	}
+
+	speed := float64(m.bytes) / elapsed.Seconds() / 1024 / 1024
+	wireSpeed := float64(m.wire) / elapsed.Seconds() / 1024 / 1024
+	if elapsed >= speedInterval {
+		m.start = time.Now()
+		m.bytes, m.wire = 0, 0
+		m.speed, m.wireSpeed = speed, wireSpeed
+	}
+	return speed, wireSpeed
+}
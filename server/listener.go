@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transferListener accepts peers over TCP, QUIC when it could be bound, and
+// WebRTC and hole-punched QUIC once rendezvous has started meeting them
+// through the relay.
+type transferListener struct {
+	tcp    net.Listener
+	quic   *quicListener
+	webrtc bool
+	punch  bool
+	conns  chan net.Conn
+	errs   chan error
+	closed chan struct{}
+	once   sync.Once
+}
+
+// listenTransfer opens the listeners the side that opens a session waits on
+// and returns the endpoint to publish for them. QUIC is skipped, leaving
+// peers on TCP, when it is disabled or its socket cannot be opened.
+func listenTransfer() (*transferListener, TransferSession, error) {
+	tcp, err := listenTCP(TRANSFER_PORT)
+	if err != nil {
+		return nil, TransferSession{}, fmt.Errorf("failed to start listener: %v", err)
+	}
+
+	_, port, err := net.SplitHostPort(tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return nil, TransferSession{}, fmt.Errorf("failed to resolve listening port: %v", err)
+	}
+
+	l := &transferListener{
+		tcp:    tcp,
+		conns:  make(chan net.Conn),
+		errs:   make(chan error, 1),
+		closed: make(chan struct{}),
+	}
+	endpoint := TransferSession{
+		SenderAddrs: LocalAddresses(),
+		SenderPort:  port,
+	}
+
+	go l.serve(tcp, true)
+	if QUIC {
+		if q, err := listenQUIC(port); err == nil {
+			l.quic = q
+			_, endpoint.QUICPort, _ = net.SplitHostPort(q.Addr().String())
+			go l.serve(q, false)
+		}
+	}
+	if WEBRTC {
+		l.webrtc = true
+		endpoint.WebRTC = true
+	}
+	if PUNCH {
+		l.punch = true
+		endpoint.Punch = true
+	}
+	return l, endpoint, nil
+}
+
+// listenTCP binds the first free port of ports: one port, a range such as
+// "3001-3010", or "0" for any port the system picks. The port actually bound
+// is published with the session, so peers never assume one.
+func listenTCP(ports string) (net.Listener, error) {
+	first, last, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		if _, err := parsePort(ports, 0); err != nil {
+			return nil, fmt.Errorf("invalid transfer port %q: %v", ports, err)
+		}
+		return net.Listen("tcp", ":"+ports)
+	}
+
+	from, err := parsePort(first, 1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", ports, err)
+	}
+	to, err := parsePort(last, 1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", ports, err)
+	}
+	if to < from {
+		return nil, fmt.Errorf("invalid port range %q: it ends before it starts", ports)
+	}
+
+	for port := from; port <= to; port++ {
+		if tcp, err := net.Listen("tcp", ":"+strconv.Itoa(port)); err == nil {
+			return tcp, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in %s", ports)
+}
+
+// parsePort reads a port number between lowest and 65535.
+func parsePort(port string, lowest int) (int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a port number", port)
+	}
+	if n < lowest || n > 65535 {
+		return 0, fmt.Errorf("port %d is outside %d-65535", n, lowest)
+	}
+	return n, nil
+}
+
+// rendezvous answers WebRTC offers and punches holes to peers that register
+// with the relay for the session, which only exists once the endpoint was
+// published, until the listener is closed.
+func (l *transferListener) rendezvous(sessionID string, role Role) {
+	settings := currentPeerSettings()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-l.closed
+		cancel()
+	}()
+
+	if l.webrtc {
+		go answerWebRTC(ctx, settings, sessionID, string(role), l.deliver)
+	}
+	if l.punch {
+		go l.punchPeers(ctx, settings, sessionID, role)
+	}
+}
+
+func (l *transferListener) punchPeers(ctx context.Context, settings peerSettings, sessionID string, role Role) {
+	for {
+		conn, err := acceptPunched(ctx, settings, sessionID, role)
+		if err != nil {
+			if ctx.Err() != nil || err == ErrSessionNotFound {
+				return
+			}
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		l.deliver(conn)
+	}
+}
+
+// peerSettings is what meeting a peer through the relay depends on, read
+// once up front since answering peers outlives the call that started it.
+type peerSettings struct {
+	relayURL   string
+	relayAddr  string
+	iceServers []string
+	loopback   bool
+	streams    int
+	listenUDP  func() (net.PacketConn, error)
+}
+
+func currentPeerSettings() peerSettings {
+	return peerSettings{
+		relayURL:   RELAY_PROTOCOL + "://" + RELAY_SERVER,
+		relayAddr:  RELAY_SERVER,
+		iceServers: ICE_SERVERS,
+		loopback:   WEBRTC_LOOPBACK,
+		streams:    STREAMS,
+		listenUDP:  ListenUDP,
+	}
+}
+
+func (l *transferListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// serve hands the connections listener accepts to Accept. Only a failing
+// TCP listener ends the session; when QUIC fails, peers that have not
+// connected yet still reach the sender over TCP and the other transports.
+func (l *transferListener) serve(listener net.Listener, fatal bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if fatal {
+				l.errs <- err
+			}
+			return
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (l *transferListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *transferListener) Close() error {
+	err := l.tcp.Close()
+	l.once.Do(func() {
+		close(l.closed)
+		if l.quic != nil {
+			l.quic.Close()
+		}
+	})
+	return err
+}
+
+func (l *transferListener) Addr() net.Addr {
+	return l.tcp.Addr()
+}
@@ -1,8 +1,25 @@
 package server
 
+import (
+	"ft_0/protocol"
+	"time"
+)
+
 var (
-	CHUNK_SIZE     = 1024 * 32
-	RELAY_PROTOCOL = "http"
-	RELAY_SERVER   = "localhost:3000"
-	TRANSFER_PORT  = "3001"
+	CHUNK_SIZE      = 1024 * 32
+	RELAY_PROTOCOL  = "http"
+	RELAY_SERVER    = "localhost:3000"
+	TRANSFER_PORT   = "0"
+	STREAMS         = 4
+	QUIC            = true
+	WEBRTC          = true
+	ICE_SERVERS     []string
+	WEBRTC_LOOPBACK = false
+	PUNCH           = true
+	DISCOVERY       = true
+	DISCOVERY_PORT  = "3002"
+	RATE_LIMIT      int64
+	PART_EXPIRY     = 7 * 24 * time.Hour
 )
+
+var capabilities = []string{protocol.CapSHA256, protocol.CapResume, protocol.CapZstd, protocol.CapGzip, protocol.CapSkip, protocol.CapStream}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// maxFailedHandshakes ends a multi-receiver session once this many peers
+// tried a wrong code, so the secret cannot be guessed at. Peers that drop
+// before the key exchange settles anything are not counted, or anyone who
+// sees the session ID could end it.
+const maxFailedHandshakes = 3
+
+// serveReceivers accepts receivers until opts' limits are reached and runs
+// each transfer on its own goroutine. Only receivers that prove they know the
+// code count toward the limit. Extra parallel streams are not offered, since
+// their connections could not be told apart from new receivers on the shared
+// listener. A receiver that drops can rejoin as a new one and resume.
+func serveReceivers(prepare func() ([]outgoingFile, error), listener net.Listener, sessionID, code string, opts MultiOptions, limiter *Limiter, progressChan chan<- SendProgress, ctx context.Context) {
+	acceptCtx := ctx
+	if opts.Timeout > 0 {
+		var stop context.CancelFunc
+		acceptCtx, stop = context.WithTimeout(ctx, opts.Timeout)
+		defer stop()
+	}
+	acceptCtx, stopAccepting := context.WithCancel(acceptCtx)
+	defer stopAccepting()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	served, failed := 0, 0
+	var sessionErr error
+
+	cm := NewConnectionManager()
+	for {
+		conn, err := waitForPeer(acceptCtx, listener, sessionID, RoleSender, cm)
+		if err == errCancelled {
+			break
+		}
+		if err != nil {
+			stopAccepting()
+			wg.Wait()
+			progressChan <- SendProgress{
+				State: StateError,
+				Error: err,
+			}
+			return
+		}
+
+		receiver, addr := 0, conn.RemoteAddr().String()
+		admit := func(err error) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if errors.Is(err, ErrWrongCode) {
+					failed++
+				}
+				if failed >= maxFailedHandshakes {
+					sessionErr = ErrTooManyAttempts
+					stopAccepting()
+				}
+				return false
+			}
+			if opts.MaxReceivers > 0 && served >= opts.MaxReceivers {
+				return false
+			}
+			served++
+			receiver = served
+			if served == opts.MaxReceivers {
+				stopAccepting()
+			}
+			return true
+		}
+		updates := make(chan SendProgress)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for p := range updates {
+				// Peers that never proved they know the code are not receivers.
+				if receiver == 0 {
+					continue
+				}
+				p.Receiver = receiver
+				p.ReceiverAddr = addr
+				progressChan <- p
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			defer close(updates)
+			if _, resumable := sendFiles(prepare, code, conn, nil, admit, limiter, updates, ctx); resumable {
+				updates <- SendProgress{
+					State: StateError,
+					Error: fmt.Errorf("connection lost - the receiver can rejoin to resume"),
+				}
+			}
+		}()
+
+		progressChan <- SendProgress{
+			State:     StateWaitingForReceiver,
+			SessionID: sessionID,
+			Code:      code,
+		}
+	}
+
+	wg.Wait()
+	if sessionErr != nil {
+		progressChan <- SendProgress{
+			State: StateError,
+			Error: sessionErr,
+		}
+		return
+	}
+	state := StateCompleted
+	if ctx.Err() != nil {
+		state = StateCancelled
+	}
+	progressChan <- SendProgress{
+		State:     state,
+		SessionID: sessionID,
+		Code:      code,
+	}
+}
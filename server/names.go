@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeName normalizes a slash-separated name offered by a sender. Names
+// that could leave the destination are rejected; characters and device names
+// that are merely awkward are rewritten.
+func sanitizeName(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) ||
+		len(name) >= 2 && name[1] == ':' && unicode.IsLetter(rune(name[0])) {
+		return "", ErrUnsafePath
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return "", ErrUnsafePath
+		}
+		parts[i] = sanitizePart(part)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+func sanitizePart(part string) string {
+	part = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '\\' || runtime.GOOS == "windows" && strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, part)
+
+	if runtime.GOOS == "windows" {
+		if trimmed := strings.TrimRight(part, ". "); trimmed != part {
+			part = trimmed + "_"
+		}
+	}
+
+	base, _, _ := strings.Cut(part, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		part = "_" + part
+	}
+	return part
+}
+
+func destinationPath(root, name string) (string, error) {
+	clean, err := sanitizeName(name)
+	if err != nil || clean != name {
+		return "", fmt.Errorf("refusing unsafe file name %q", name)
+	}
+	return filepath.Join(root, filepath.FromSlash(clean)), nil
+}
+
+// confine makes sure nothing below root on the way to path is a symlink, so
+// writes cannot be redirected outside of it by links already on disk.
+func confine(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to write '%s' outside of '%s'", path, root)
+	}
+
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink '%s'", current)
+		}
+	}
+	return nil
+}
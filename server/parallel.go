@@ -0,0 +1,602 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"ft_0/protocol"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	rangeSize         = 1 << 20
+	parallelThreshold = 4 << 20
+	// rangeWindow is how many ranges a sender hands out past the first one
+	// still in flight, and how much either side holds in memory for hashing.
+	rangeWindow = 16
+)
+
+type streamFunc func(ctx context.Context) (net.Conn, error)
+
+type streamGroup struct {
+	mu          sync.Mutex
+	streams     []*protocol.Conn
+	setDeadline func(*protocol.Conn, time.Time) error
+	stopped     bool
+}
+
+func (g *streamGroup) extend(stream *protocol.Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped {
+		return false
+	}
+	g.setDeadline(stream, time.Now().Add(30*time.Second))
+	return true
+}
+
+func (g *streamGroup) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stopped = true
+	for _, stream := range g.streams {
+		g.setDeadline(stream, time.Now())
+	}
+}
+
+type rangeProgress struct {
+	offset  int64
+	length  int64
+	written int64
+	data    []byte
+}
+
+// rangeHash feeds ranges to a file's hash in order as they complete on any
+// stream. Ranges that finish ahead of the next one in line are held until it
+// arrives, so the file never has to be read again to hash it. Past
+// rangeWindow of held data, further ranges are only noted and read back from
+// the file when their turn comes, so a peer that runs far ahead can't make
+// the other side hold the whole file in memory.
+type rangeHash struct {
+	mu      sync.Mutex
+	wake    *sync.Cond
+	hash    hash.Hash
+	file    io.ReaderAt
+	next    int64
+	pending map[int64]heldRange
+	held    int64
+	closed  bool
+}
+
+// heldRange is a completed range waiting for its turn; data is nil once it
+// has to be read back from the file.
+type heldRange struct {
+	data   []byte
+	length int64
+}
+
+func newRangeHash(hash hash.Hash, file io.ReaderAt, offset int64) *rangeHash {
+	h := &rangeHash{hash: hash, file: file, next: offset, pending: make(map[int64]heldRange)}
+	h.wake = sync.NewCond(&h.mu)
+	return h
+}
+
+func (h *rangeHash) add(offset int64, data []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	length := int64(len(data))
+	if offset != h.next && h.held+length > rangeWindow*rangeSize {
+		h.pending[offset] = heldRange{length: length}
+	} else {
+		h.pending[offset] = heldRange{data: data, length: length}
+		h.held += length
+	}
+
+	for {
+		r, exists := h.pending[h.next]
+		if !exists {
+			break
+		}
+		delete(h.pending, h.next)
+		if r.data == nil {
+			if _, err := io.Copy(h.hash, io.NewSectionReader(h.file, h.next, r.length)); err != nil {
+				return err
+			}
+		} else {
+			h.hash.Write(r.data)
+			h.held -= r.length
+		}
+		h.next += r.length
+	}
+	h.wake.Broadcast()
+	return nil
+}
+
+// wait blocks until the range at offset is within rangeWindow of the hashed
+// prefix, so a stalled stream can't make the others buffer the whole file.
+func (h *rangeHash) wait(offset int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for !h.closed && offset-h.next >= rangeWindow*rangeSize {
+		h.wake.Wait()
+	}
+	return !h.closed
+}
+
+func (h *rangeHash) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	h.wake.Broadcast()
+}
+
+func joinStream(stream *protocol.Conn, code, token string, initiator bool) error {
+	if err := secureHandshake(stream, code, initiator); err != nil {
+		return err
+	}
+
+	if initiator {
+		if err := stream.Send(protocol.MsgStreamJoin, protocol.StreamJoin{Token: token}); err != nil {
+			return err
+		}
+	}
+
+	frame, err := stream.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if frame.Type != protocol.MsgStreamJoin {
+		return remoteError(frame)
+	}
+
+	var join protocol.StreamJoin
+	if err := frame.Decode(&join); err != nil {
+		return err
+	}
+	if join.Token != token {
+		return fmt.Errorf("stream belongs to another transfer")
+	}
+
+	if !initiator {
+		return stream.Send(protocol.MsgStreamJoin, protocol.StreamJoin{Token: token})
+	}
+	return nil
+}
+
+// openStreams asks the receiver for count extra streams and accepts them.
+// The receiver reports how many it managed to open, so the sender stops
+// waiting once those joined, and keeps to the main connection if the two
+// sides don't agree on which streams are part of the transfer.
+func (b *batchSender) openStreams(code string, count int, accept streamFunc) []*protocol.Conn {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil
+	}
+
+	open := protocol.StreamOpen{Token: hex.EncodeToString(token), Count: count}
+	if err := b.conn.Send(protocol.MsgStreamOpen, open); err != nil {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+
+	joined := make(chan *protocol.Conn)
+	go func() {
+		defer close(joined)
+		for {
+			raw, err := accept(waitCtx)
+			if err != nil {
+				return
+			}
+
+			stream := protocol.NewConn(raw)
+			stream.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := joinStream(stream, code, open.Token, false); err != nil {
+				stream.Close()
+				continue
+			}
+			stream.SetDeadline(time.Time{})
+
+			select {
+			case joined <- stream:
+			case <-waitCtx.Done():
+				stream.Close()
+				return
+			}
+		}
+	}()
+
+	var streams []*protocol.Conn
+	opened := -1
+	for opened < 0 || len(streams) < opened {
+		select {
+		case stream, ok := <-joined:
+			if !ok {
+				closeStreams(streams)
+				return nil
+			}
+			streams = append(streams, stream)
+
+		case result := <-b.reply:
+			var report protocol.StreamOpen
+			if result.err != nil || result.frame.Type != protocol.MsgStreamOpen || result.frame.Decode(&report) != nil || report.Token != open.Token {
+				// Leave whatever the receiver sent for the transfer to handle.
+				replay := make(chan frameResult, 1)
+				replay <- result
+				b.reply = replay
+				closeStreams(streams)
+				return nil
+			}
+			b.reply = readFrameAsync(b.conn)
+			opened = report.Count
+		}
+	}
+
+	if len(streams) != opened {
+		closeStreams(streams)
+		return nil
+	}
+	return streams
+}
+
+func openReceiverStreams(ctx context.Context, code string, dial streamFunc, open protocol.StreamOpen) []*protocol.Conn {
+	var streams []*protocol.Conn
+	for range min(open.Count, STREAMS-1) {
+		dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		raw, err := dial(dialCtx)
+		cancel()
+		if err != nil {
+			break
+		}
+
+		stream := protocol.NewConn(raw)
+		stream.SetDeadline(time.Now().Add(15 * time.Second))
+		if err := joinStream(stream, code, open.Token, true); err != nil {
+			stream.Close()
+			break
+		}
+		stream.SetDeadline(time.Time{})
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func closeStreams(streams []*protocol.Conn) {
+	for _, stream := range streams {
+		stream.Close()
+	}
+}
+
+func parallelCandidate(files []outgoingFile, accept protocol.Accept) bool {
+	for i, f := range files {
+		if !f.entry.Dir && !accept.Files[i].Skip && f.entry.Size-accept.Files[i].Offset >= parallelThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *batchSender) sendRanges(index int, f outgoingFile, file *os.File, offset int64, compression string, hash hash.Hash) error {
+	group := &streamGroup{
+		streams:     append([]*protocol.Conn{b.conn}, b.streams...),
+		setDeadline: (*protocol.Conn).SetWriteDeadline,
+	}
+	hashed := newRangeHash(hash, file, offset)
+	stop := func() {
+		group.stop()
+		hashed.close()
+	}
+
+	var mu sync.Mutex
+	next := offset
+	take := func() (int64, int64, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if next >= f.entry.Size || !hashed.wait(next) {
+			return 0, 0, false
+		}
+		start, length := next, min(rangeSize, f.entry.Size-next)
+		next += length
+		return start, length, true
+	}
+
+	errs := make(chan error, len(group.streams))
+	for i, stream := range group.streams {
+		go func() {
+			errs <- b.sendStream(group, stream, i, index, f, file, compression, take, hashed)
+		}()
+	}
+
+	var firstErr error
+	for remaining := len(group.streams); remaining > 0; {
+		select {
+		case err := <-errs:
+			remaining--
+			if err != nil && firstErr == nil {
+				firstErr = err
+				stop()
+			}
+		case result := <-b.reply:
+			b.reply = nil
+			if firstErr == nil {
+				firstErr = fmt.Errorf("receiver stopped the transfer: %v", remoteError(result.frame))
+				if result.err != nil {
+					firstErr = connectionLost{fmt.Errorf("receiver stopped the transfer: %v", result.err)}
+				}
+				stop()
+			}
+		case <-b.ctx.Done():
+			if firstErr == nil {
+				firstErr = errCancelled
+				stop()
+			}
+		}
+	}
+
+	if firstErr == errCancelled {
+		b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		b.conn.Send(protocol.MsgCancel, protocol.Cancel{})
+	}
+	return firstErr
+}
+
+func (b *batchSender) sendStream(group *streamGroup, stream *protocol.Conn, streamIndex, index int, f outgoingFile, file *os.File, compression string, take func() (int64, int64, bool), hashed *rangeHash) error {
+	var compressor compressor
+	if compression != "" {
+		compressor = b.streamCompressor(streamIndex)
+	}
+
+	buffer := make([]byte, CHUNK_SIZE)
+	var packed []byte
+
+	for {
+		start, length, ok := take()
+		if !ok {
+			break
+		}
+
+		if err := stream.Send(protocol.MsgRange, protocol.Range{Index: index, Offset: start, Length: length}); err != nil {
+			return connectionLost{fmt.Errorf("error sending file data: %v", err)}
+		}
+
+		data := make([]byte, 0, length)
+		section := io.NewSectionReader(file, start, length)
+		for {
+			n, err := section.Read(buffer)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading file '%s': %v", f.path, err)
+			}
+			data = append(data, buffer[:n]...)
+
+			msgType, payload := protocol.MsgData, buffer[:n]
+			if compressor != nil {
+				if packed, err = compressor.compress(packed[:0], payload); err != nil {
+					return fmt.Errorf("error compressing file '%s': %v", f.path, err)
+				}
+				if len(packed) < n {
+					msgType, payload = protocol.MsgCompressed, packed
+				}
+			}
+
+			if err := throttle(b.ctx, b.limiter, len(payload)); err != nil {
+				return err
+			}
+			if !group.extend(stream) {
+				return errCancelled
+			}
+			if err := stream.WriteFrame(msgType, payload); err != nil {
+				return connectionLost{fmt.Errorf("error sending file data: %v", err)}
+			}
+
+			b.advance(index, f.entry, n, len(payload))
+		}
+		if err := hashed.add(start, data); err != nil {
+			return fmt.Errorf("error reading file '%s': %v", f.path, err)
+		}
+	}
+
+	if err := stream.Send(protocol.MsgRange, protocol.Range{Index: index, End: true}); err != nil {
+		return connectionLost{fmt.Errorf("error sending file data: %v", err)}
+	}
+	return nil
+}
+
+func (b *batchSender) streamCompressor(streamIndex int) compressor {
+	if streamIndex == 0 {
+		return b.compressor
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.streamCompressors) < streamIndex {
+		b.streamCompressors = append(b.streamCompressors, nil)
+	}
+	if b.streamCompressors[streamIndex-1] == nil {
+		b.streamCompressors[streamIndex-1], _ = newCompressor(b.compression)
+	}
+	return b.streamCompressors[streamIndex-1]
+}
+
+func (b *batchReceiver) openStreams(frame protocol.Frame) error {
+	var open protocol.StreamOpen
+	if err := frame.Decode(&open); err != nil {
+		return err
+	}
+
+	closeStreams(b.streams)
+	b.streams = nil
+	if b.dial != nil {
+		b.streams = openReceiverStreams(b.ctx, b.code, b.dial, open)
+	}
+
+	return b.conn.Send(protocol.MsgStreamOpen, protocol.StreamOpen{Token: open.Token, Count: len(b.streams)})
+}
+
+func (b *batchReceiver) receiveRanges() error {
+	group := &streamGroup{
+		streams:     append([]*protocol.Conn{b.conn}, b.streams...),
+		setDeadline: (*protocol.Conn).SetReadDeadline,
+	}
+	defer context.AfterFunc(b.ctx, group.stop)()
+
+	errs := make(chan error, len(group.streams))
+	for _, stream := range group.streams {
+		go func() {
+			errs <- b.receiveStream(group, stream)
+		}()
+	}
+
+	var firstErr error
+	for range group.streams {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			group.stop()
+		}
+	}
+
+	if b.ctx.Err() != nil {
+		return errCancelled
+	}
+	return firstErr
+}
+
+func (b *batchReceiver) receiveStream(group *streamGroup, stream *protocol.Conn) error {
+	var codec compressor
+	if b.compression != "" {
+		var err error
+		if codec, err = newCompressor(b.compression); err != nil {
+			return err
+		}
+	}
+
+	entry := b.files[b.index]
+	var current *rangeProgress
+	for {
+		if !group.extend(stream) {
+			return errCancelled
+		}
+		frame, err := stream.ReadFrame()
+		if err != nil {
+			return fmt.Errorf("failed to read from connection: %v", err)
+		}
+
+		switch frame.Type {
+		case protocol.MsgRange:
+			var r protocol.Range
+			if err := frame.Decode(&r); err != nil {
+				return err
+			}
+
+			switch {
+			case current != nil && current.written < current.length, r.Index != b.index:
+				sendError(b.conn, ErrUnexpectedMessage)
+				return fmt.Errorf("sender started an unexpected range")
+			case r.End:
+				return nil
+			case r.Length <= 0 || r.Length > rangeSize || r.Offset < b.offsets[b.index] || r.Offset+r.Length > entry.Size:
+				sendError(b.conn, ErrUnexpectedMessage)
+				return fmt.Errorf("sender sent an invalid range for '%s'", entry.Name)
+			}
+
+			current = &rangeProgress{offset: r.Offset, length: r.Length, data: make([]byte, 0, r.Length)}
+			b.mu.Lock()
+			b.ranges = append(b.ranges, current)
+			b.mu.Unlock()
+
+		case protocol.MsgData, protocol.MsgCompressed:
+			if current == nil {
+				sendError(b.conn, ErrUnexpectedMessage)
+				return fmt.Errorf("sender sent data outside of a range")
+			}
+
+			data := frame.Payload
+			if frame.Type == protocol.MsgCompressed {
+				if codec == nil {
+					sendError(b.conn, ErrUnexpectedMessage)
+					return fmt.Errorf("sender sent compressed data outside of a compressed file")
+				}
+				if data, err = codec.decompress(frame.Payload); err != nil {
+					sendError(b.conn, ErrCorruptData)
+					return fmt.Errorf("failed to decompress data for '%s': %v", entry.Name, err)
+				}
+			}
+
+			if err := b.writeAt(current, data, len(frame.Payload)); err != nil {
+				return err
+			}
+
+		case protocol.MsgCancel:
+			return errSenderCancelled
+
+		default:
+			return remoteError(frame)
+		}
+	}
+}
+
+func (b *batchReceiver) writeAt(r *rangeProgress, data []byte, wireSize int) error {
+	entry := b.files[b.index]
+	if r.written+int64(len(data)) > r.length {
+		sendError(b.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender sent more data than announced for '%s'", entry.Name)
+	}
+	if err := throttle(b.ctx, b.limiter, wireSize); err != nil {
+		return err
+	}
+
+	if _, err := b.file.WriteAt(data, r.offset+r.written); err != nil {
+		sendError(b.conn, ErrWriteFailed)
+		return fmt.Errorf("failed to write to file '%s': %v", partPath(b.names[b.index]), err)
+	}
+
+	b.mu.Lock()
+	r.written += int64(len(data))
+	b.advance(len(data), wireSize)
+	b.mu.Unlock()
+
+	r.data = append(r.data, data...)
+	if r.written == r.length {
+		err := b.hashed.add(r.offset, r.data)
+		r.data = nil
+		if err != nil {
+			sendError(b.conn, ErrWriteFailed)
+			return fmt.Errorf("failed to read back file '%s': %v", partPath(b.names[b.index]), err)
+		}
+	}
+	return nil
+}
+
+func (b *batchReceiver) contiguous() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ranges := slices.Clone(b.ranges)
+	slices.SortFunc(ranges, func(a, c *rangeProgress) int {
+		return cmp.Compare(a.offset, c.offset)
+	})
+
+	prefix := b.offsets[b.index]
+	for _, r := range ranges {
+		if r.offset != prefix {
+			break
+		}
+		prefix += r.written
+		if r.written < r.length {
+			break
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const pipeUpgrade = "ft0-pipe"
+
+type pipeEnd struct {
+	role      string
+	conn      net.Conn
+	watchDone chan struct{}
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (s *RelayServer) handlePipe(w http.ResponseWriter, r *http.Request, sessionID string) {
+	role := r.URL.Query().Get("role")
+	if role != "sender" && role != "receiver" {
+		http.Error(w, "Invalid pipe role", http.StatusBadRequest)
+		return
+	}
+
+	if _, exists := s.sessions.Load(sessionID); !exists {
+		http.Error(w, fmt.Sprintf("Session '%s' not found", sessionID), http.StatusNotFound)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Relay forwarding not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	if buf.Reader.Buffered() > 0 {
+		conn.Close()
+		return
+	}
+
+	s.pipeMu.Lock()
+	peer, waiting := s.pipes[sessionID]
+	if waiting && peer.role == role {
+		s.pipeMu.Unlock()
+		io.WriteString(conn, "HTTP/1.1 409 Conflict\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	if !waiting {
+		end := &pipeEnd{
+			role:      role,
+			conn:      conn,
+			watchDone: make(chan struct{}),
+		}
+		s.pipes[sessionID] = end
+		s.pipeMu.Unlock()
+		go s.watchPipe(sessionID, end)
+		return
+	}
+
+	delete(s.pipes, sessionID)
+	s.pipeMu.Unlock()
+
+	peer.conn.SetReadDeadline(time.Now())
+	<-peer.watchDone
+	peer.conn.SetReadDeadline(time.Time{})
+
+	s.logChan <- fmt.Sprintf("%d: forwarding session %s through relay", time.Now().Unix(), sessionID)
+	go splice(peer.conn, conn)
+}
+
+func (s *RelayServer) watchPipe(sessionID string, end *pipeEnd) {
+	defer close(end.watchDone)
+
+	buf := make([]byte, 1)
+	end.conn.Read(buf)
+
+	s.pipeMu.Lock()
+	defer s.pipeMu.Unlock()
+	if s.pipes[sessionID] == end {
+		delete(s.pipes, sessionID)
+		end.conn.Close()
+	}
+}
+
+func (s *RelayServer) closePipes() {
+	s.pipeMu.Lock()
+	defer s.pipeMu.Unlock()
+	for sessionID, end := range s.pipes {
+		end.conn.Close()
+		delete(s.pipes, sessionID)
+	}
+}
+
+func splice(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	upgrade := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + pipeUpgrade + "\r\n\r\n"
+	if _, err := io.WriteString(a, upgrade); err != nil {
+		return
+	}
+	if _, err := io.WriteString(b, upgrade); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	forward := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+
+	go forward(a, b)
+	go forward(b, a)
+	<-done
+	<-done
+}
+
+func DialRelayPipe(ctx context.Context, sessionID, role string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if RELAY_PROTOCOL == "https" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", RELAY_SERVER)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", RELAY_SERVER)
+	}
+	if err != nil {
+		return nil, ErrRelayServerDown
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	req, err := http.NewRequest("GET",
+		RELAY_PROTOCOL+"://"+RELAY_SERVER+"/pipe/"+sessionID+"?role="+role, nil)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", pipeUpgrade)
+
+	if err := req.Write(conn); err != nil {
+		stop()
+		conn.Close()
+		return nil, fmt.Errorf("failed to request relay forwarding: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("relay forwarding failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("relay forwarding unavailable (status %d)", resp.StatusCode)
+	}
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
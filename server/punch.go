@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	punchInterval    = 100 * time.Millisecond
+	registerInterval = 500 * time.Millisecond
+	punchTimeout     = 5 * time.Second
+)
+
+// Punch packets start with a zero byte, which QUIC packets never do, so the
+// ones still arriving once QUIC runs on the socket are dropped.
+var punchMagic = []byte{0x00, 'f', 't', '0'}
+
+// ListenUDP opens the socket hole punching uses. Tests replace it to put
+// peers behind a simulated NAT.
+var ListenUDP = func() (net.PacketConn, error) {
+	return net.ListenPacket("udp", ":0")
+}
+
+func punchPacket(sessionID string, role Role) []byte {
+	return append(append([]byte{}, punchMagic...), sessionID+"/"+string(role)...)
+}
+
+// punch registers sock with the relay's rendezvous as role's side of the
+// session and sends punch packets to the candidates the other side
+// registered until one of its own arrives. Both NATs then pass traffic
+// between sock and the returned address: ours because we sent to it, theirs
+// because its packet got out to us.
+func punch(ctx context.Context, settings peerSettings, sock net.PacketConn, sessionID string, role Role) (net.Addr, error) {
+	relay, err := net.ResolveUDPAddr("udp", settings.relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	_, port, err := net.SplitHostPort(sock.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	var local []string
+	for _, ip := range LocalAddresses() {
+		local = append(local, net.JoinHostPort(ip, port))
+	}
+	register, err := json.Marshal(rendezvous{Session: sessionID, Role: role, Local: local})
+	if err != nil {
+		return nil, err
+	}
+
+	peer := RoleSender
+	if role == RoleSender {
+		peer = RoleReceiver
+	}
+	hello, peerHello := punchPacket(sessionID, role), punchPacket(sessionID, peer)
+
+	found := make(chan net.Addr, 1)
+	candidates := make(chan []string, 1)
+	errs := make(chan error, 1)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := sock.ReadFrom(buf)
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+				return
+			}
+
+			switch {
+			case bytes.Equal(buf[:n], peerHello):
+				select {
+				case found <- addr:
+				default:
+				}
+			case addr.String() == relay.String():
+				var reply rendezvousReply
+				if json.Unmarshal(buf[:n], &reply) != nil {
+					continue
+				}
+				if reply.Error == ErrSessionNotFound.Code {
+					errs <- ErrSessionNotFound
+					return
+				}
+				if len(reply.Peer) > 0 {
+					select {
+					case <-candidates:
+					default:
+					}
+					candidates <- reply.Peer
+				}
+			}
+		}
+	}()
+	defer func() {
+		sock.SetReadDeadline(time.Now())
+		<-readerDone
+		sock.SetReadDeadline(time.Time{})
+	}()
+
+	registerTicker := time.NewTicker(registerInterval)
+	defer registerTicker.Stop()
+	punchTicker := time.NewTicker(punchInterval)
+	defer punchTicker.Stop()
+
+	sock.WriteTo(register, relay)
+	var targets []net.Addr
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case err := <-errs:
+			return nil, err
+		case addr := <-found:
+			// The peer may still be waiting for one of ours to get through.
+			for range 3 {
+				sock.WriteTo(hello, addr)
+			}
+			return addr, nil
+		case peerCandidates := <-candidates:
+			targets = targets[:0]
+			for _, candidate := range peerCandidates {
+				if addr, err := net.ResolveUDPAddr("udp", candidate); err == nil {
+					targets = append(targets, addr)
+				}
+			}
+		case <-registerTicker.C:
+			sock.WriteTo(register, relay)
+		case <-punchTicker.C:
+			for _, addr := range targets {
+				sock.WriteTo(hello, addr)
+			}
+		}
+	}
+}
+
+// dialPunched punches a hole to the peer that opened the session and
+// connects to it over QUIC on the punched socket.
+func dialPunched(settings peerSettings, sessionID string, role Role) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), punchTimeout)
+	defer cancel()
+
+	sock, err := settings.listenUDP()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := func() (net.Conn, error) {
+		addr, err := punch(ctx, settings, sock, sessionID, role)
+		if err != nil {
+			return nil, err
+		}
+
+		transport := &quic.Transport{Conn: sock}
+		qc, err := transport.Dial(ctx, addr, quicClientTLS(), quicConfig)
+		if err != nil {
+			transport.Close()
+			return nil, err
+		}
+
+		stream, err := qc.OpenStreamSync(ctx)
+		if err == nil {
+			_, err = stream.Write([]byte{quicPreamble})
+		}
+		if err != nil {
+			qc.CloseWithError(0, "")
+			transport.Close()
+			return nil, err
+		}
+
+		go releasePunched(qc, transport, sock)
+		return &quicStream{Stream: stream, conn: qc, owner: true, punched: true}, nil
+	}()
+	if err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("hole punching failed: %v", err)
+	}
+	return conn, nil
+}
+
+// acceptPunched waits for a peer of the session to register with the relay's
+// rendezvous, punches a hole to it and accepts its QUIC connection on the
+// punched socket.
+func acceptPunched(ctx context.Context, settings peerSettings, sessionID string, role Role) (net.Conn, error) {
+	sock, err := settings.listenUDP()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := func() (net.Conn, error) {
+		if _, err := punch(ctx, settings, sock, sessionID, role); err != nil {
+			return nil, err
+		}
+
+		tlsConfig, err := quicServerTLS()
+		if err != nil {
+			return nil, err
+		}
+		transport := &quic.Transport{Conn: sock}
+		listener, err := transport.Listen(tlsConfig, quicConfig)
+		if err != nil {
+			transport.Close()
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, punchTimeout)
+		defer cancel()
+
+		qc, err := listener.Accept(ctx)
+		listener.Close()
+		if err != nil {
+			transport.Close()
+			return nil, err
+		}
+
+		stream, err := qc.AcceptStream(ctx)
+		if err != nil {
+			qc.CloseWithError(0, "")
+			transport.Close()
+			return nil, err
+		}
+		conn, err := readPreamble(stream, qc, true)
+		if err != nil {
+			qc.CloseWithError(0, "")
+			transport.Close()
+			return nil, err
+		}
+
+		conn.(*quicStream).punched = true
+		go releasePunched(qc, transport, sock)
+		return conn, nil
+	}()
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// releasePunched closes a punched socket once the connection on it ended.
+func releasePunched(qc *quic.Conn, transport *quic.Transport, sock net.PacketConn) {
+	<-qc.Context().Done()
+	transport.Close()
+	sock.Close()
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	quicProtocol = "ft0"
+	quicLinger   = 2 * time.Second
+)
+
+// Every stream starts with this byte from the side that opened it, since a
+// QUIC stream only reaches the peer's AcceptStream once data is sent on it
+// and either side may be the first to speak.
+const quicPreamble = 0x00
+
+var quicConfig = &quic.Config{
+	KeepAlivePeriod: 10 * time.Second,
+}
+
+// quicStream is a QUIC stream used as a net.Conn. The stream a connection
+// was set up with owns it: closing that stream closes the connection once
+// the peer had a moment to read what was written last. Punched marks
+// connections on a hole-punched socket.
+type quicStream struct {
+	*quic.Stream
+	conn    *quic.Conn
+	owner   bool
+	punched bool
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	err := s.Stream.Close()
+	if s.owner {
+		go func() {
+			select {
+			case <-s.conn.Context().Done():
+			case <-time.After(quicLinger):
+			}
+			s.conn.CloseWithError(0, "")
+		}()
+	}
+	return err
+}
+
+// openStream starts another stream on the same connection, used by the
+// receiver for parallel transfer streams.
+func (s *quicStream) openStream(ctx context.Context) (net.Conn, error) {
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write([]byte{quicPreamble}); err != nil {
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: s.conn}, nil
+}
+
+// acceptStream waits for a stream the peer opened with openStream.
+func (s *quicStream) acceptStream(ctx context.Context) (net.Conn, error) {
+	stream, err := s.conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return readPreamble(stream, s.conn, false)
+}
+
+func readPreamble(stream *quic.Stream, conn *quic.Conn, owner bool) (net.Conn, error) {
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	preamble := make([]byte, 1)
+	if _, err := stream.Read(preamble); err != nil || preamble[0] != quicPreamble {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		return nil, fmt.Errorf("invalid QUIC stream preamble")
+	}
+	stream.SetReadDeadline(time.Time{})
+	return &quicStream{Stream: stream, conn: conn, owner: owner}, nil
+}
+
+// quicListener accepts QUIC connections and hands out the first stream of
+// each one. Connections it accepted outlive it; the socket is released once
+// they are all closed.
+type quicListener struct {
+	udp       net.PacketConn
+	transport *quic.Transport
+	listener  *quic.Listener
+	mu        sync.Mutex
+	active    int
+	closed    bool
+}
+
+// listenQUIC binds the UDP port matching a session's TCP port, or any free
+// one when that is taken.
+func listenQUIC(port string) (*quicListener, error) {
+	udp, err := net.ListenPacket("udp", ":"+port)
+	if err != nil {
+		udp, err = net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConfig, err := quicServerTLS()
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+
+	transport := &quic.Transport{Conn: udp}
+	listener, err := transport.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		transport.Close()
+		udp.Close()
+		return nil, err
+	}
+	return &quicListener{udp: udp, transport: transport, listener: listener}, nil
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(conn.Context(), 10*time.Second)
+		stream, err := conn.AcceptStream(ctx)
+		cancel()
+		if err != nil {
+			conn.CloseWithError(0, "")
+			continue
+		}
+
+		c, err := readPreamble(stream, conn, true)
+		if err != nil {
+			conn.CloseWithError(0, "")
+			continue
+		}
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.CloseWithError(0, "")
+			return nil, net.ErrClosed
+		}
+		l.active++
+		l.mu.Unlock()
+
+		go func() {
+			<-conn.Context().Done()
+			l.mu.Lock()
+			l.active--
+			done := l.closed && l.active == 0
+			l.mu.Unlock()
+			if done {
+				l.shutdown()
+			}
+		}()
+		return c, nil
+	}
+}
+
+func (l *quicListener) Close() error {
+	err := l.listener.Close()
+	l.mu.Lock()
+	l.closed = true
+	done := l.active == 0
+	l.mu.Unlock()
+	if done {
+		l.shutdown()
+	}
+	return err
+}
+
+func (l *quicListener) shutdown() {
+	l.transport.Close()
+	l.udp.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.udp.LocalAddr()
+}
+
+// dialQUIC connects to the first of addrs that answers on port over QUIC
+// and opens the stream the transfer starts on.
+func dialQUIC(addrs []string, port string, timeout time.Duration) (net.Conn, error) {
+	if len(addrs) == 0 || port == "" {
+		return nil, fmt.Errorf("session has no QUIC address")
+	}
+
+	config := quicConfig.Clone()
+	config.HandshakeIdleTimeout = timeout
+
+	lastErr := errors.New("no QUIC address answered")
+	for _, addr := range addrs {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		conn, err := quic.DialAddr(ctx, net.JoinHostPort(addr, port), quicClientTLS(), config)
+		if err != nil {
+			cancel()
+			lastErr = err
+			continue
+		}
+
+		stream, err := conn.OpenStreamSync(ctx)
+		cancel()
+		if err == nil {
+			_, err = stream.Write([]byte{quicPreamble})
+		}
+		if err != nil {
+			conn.CloseWithError(0, "")
+			lastErr = err
+			continue
+		}
+		return &quicStream{Stream: stream, conn: conn, owner: true}, nil
+	}
+	return nil, lastErr
+}
+
+func transportOf(conn net.Conn) string {
+	if c, ok := conn.(*Connection); ok {
+		conn = c.Conn
+	}
+	switch c := conn.(type) {
+	case *quicStream:
+		if c.punched {
+			return "udp"
+		}
+		return "quic"
+	case *webrtcConn:
+		return "webrtc"
+	}
+	return "tcp"
+}
+
+func quicServerTLS() (*tls.Config, error) {
+	cert, err := quicCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicProtocol},
+	}, nil
+}
+
+// quicClientTLS accepts any certificate: it is thrown away after each
+// session and never checked, since peers prove they hold the code in the
+// PAKE handshake that follows.
+func quicClientTLS() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{quicProtocol},
+	}
+}
+
+func quicCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
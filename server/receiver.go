@@ -1,33 +1,106 @@
 package server
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"encoding/hex"
 	"fmt"
-	"io"
+	"ft_0/protocol"
+	"hash"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 type ReceiveProgress struct {
 	Speed         float64
 	BytesReceived int64
+	TotalBytes    int64
+	WireBytes     int64
+	WireSpeed     float64
+	Streams       int
+	FileIndex     int
+	FileName      string
+	FileBytes     int64
+	FileSize      int64
+	Files         []FileOutcome
 	Error         error
 	State         TransferState
 }
 
+type ReceiverConn struct {
+	*protocol.Conn
+	code       string
+	dial       streamFunc
+	sessionID  string
+	receiverID string
+	transport  string
+	local      bool
+}
+
+type batchReceiver struct {
+	mu            sync.Mutex
+	ctx           context.Context
+	limiter       *Limiter
+	conn          *protocol.Conn
+	code          string
+	dial          streamFunc
+	streams       []*protocol.Conn
+	progressChan  chan<- ReceiveProgress
+	files         []protocol.FileEntry
+	names         []string
+	offsets       []int64
+	policies      []ConflictPolicy
+	existing      []bool
+	outcomes      []FileOutcome
+	results       []protocol.FileResult
+	receivedBytes int64
+	resumedBytes  int64
+	totalBytes    int64
+	wireBytes     int64
+	startTime     time.Time
+	meter         rateMeter
+	compressors   map[string]compressor
+
+	index       int
+	file        *os.File
+	hash        hash.Hash
+	fileBytes   int64
+	codec       compressor
+	compression string
+	ranged      bool
+	ranges      []*rangeProgress
+	hashed      *rangeHash
+}
+
 func LeaveSession(sessionID string) error {
+	return leaveSession(sessionID, "")
+}
+
+// Leave tells the relay this receiver is done with its session, freeing its
+// place in sessions shared with several receivers. Sessions found on the
+// local network never went through the relay.
+func (rc *ReceiverConn) Leave() error {
+	if rc.local {
+		return nil
+	}
+	return leaveSession(rc.sessionID, rc.receiverID)
+}
+
+func leaveSession(sessionID, receiverID string) error {
 	if sessionID == "" {
 		return nil
 	}
 
-	resp, err := http.Get(RELAY_PROTOCOL + "://" + RELAY_SERVER + "/leave/" + sessionID)
+	url := RELAY_PROTOCOL + "://" + RELAY_SERVER + "/leave/" + sessionID
+	if receiverID != "" {
+		url += "?receiver=" + receiverID
+	}
+	resp, err := http.Get(url)
 	if err != nil {
 		return fmt.Errorf("couldn't disconnect cleanly (%v)", err.Error())
 	}
@@ -35,80 +108,249 @@ func LeaveSession(sessionID string) error {
 	return nil
 }
 
-func StartReceiver(sessionID string) (net.Conn, error) {
-	if sessionID == "" {
+func StartReceiver(code string) (*ReceiverConn, error) {
+	if code == "" {
 		return nil, SessionError{
 			Code:    "INVALID_SESSION",
 			Message: "Please enter a valid session ID",
 		}
 	}
 
-	resp, err := http.Get(RELAY_PROTOCOL + "://" + RELAY_SERVER + "/join/" + sessionID)
+	sessionID, _, err := SplitCode(code)
 	if err != nil {
-		return nil, ErrRelayServerDown
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case http.StatusNotFound:
-		return nil, ErrSessionNotFound
-	case http.StatusConflict:
-		return nil, ErrSessionConflict
-	case http.StatusOK:
-	default:
-		return nil, SessionError{
-			Code:    "UNEXPECTED_ERROR",
-			Message: fmt.Sprintf("Unexpected error (status %d) - please try again", resp.StatusCode),
+	// Whatever answered on the local network may not be the sender the code
+	// belongs to, so a failed handshake there falls back to the relay, which
+	// knows where that sender is.
+	var localErr error
+	if session, conn, dial, local := joinNearby(sessionID); local {
+		pc, err := handshakeSender(conn, code)
+		if err == nil {
+			return &ReceiverConn{Conn: pc, code: code, dial: dial, sessionID: session.SessionID, transport: transportOf(conn), local: true}, nil
+		}
+		localErr = err
+	}
+
+	session, err := NewSessionManager().Join(context.Background(), RoleReceiver, sessionID)
+	if err != nil {
+		if localErr != nil {
+			return nil, localErr
 		}
+		return nil, err
 	}
 
-	var session TransferSession
-	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
-		return nil, fmt.Errorf("invalid session data - please try again")
+	conn, dial, err := connectPeer(*session, RoleReceiver)
+	if err != nil {
+		return nil, err
 	}
 
-	conn, err := net.DialTimeout("tcp", "localhost:"+TRANSFER_PORT, 5*time.Second)
+	pc, err := handshakeSender(conn, code)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't connect to sender - are they still online? (%v)", err.Error())
+		return nil, err
 	}
+	return &ReceiverConn{Conn: pc, code: code, dial: dial, sessionID: session.SessionID, receiverID: session.ReceiverID, transport: transportOf(conn)}, nil
+}
 
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
-	return conn, nil
+func handshakeSender(conn net.Conn, code string) (*protocol.Conn, error) {
+	pc := protocol.NewConn(conn)
+	pc.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := secureHandshake(pc, code, true); err != nil {
+		pc.Close()
+		if err == ErrWrongCode || err == ErrIncompatibleVersion {
+			return nil, err
+		}
+		return nil, fmt.Errorf("handshake with sender failed: %v", err)
+	}
+	return pc, nil
 }
 
-func ReceiveMetadata(conn net.Conn) (FileMetadata, error) {
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
-	reader := bufio.NewReader(conn)
+func joinNearby(sessionID string) (*TransferSession, net.Conn, streamFunc, bool) {
+	if !DISCOVERY {
+		return nil, nil, nil, false
+	}
+
+	nearby, ok := findNearby(sessionID)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	session := &TransferSession{
+		SessionID:   nearby.SessionID,
+		SenderAddrs: nearby.Addrs,
+		SenderPort:  nearby.Port,
+		QUICPort:    nearby.QUICPort,
+	}
+	if QUIC && session.QUICPort != "" {
+		if conn, err := dialQUIC(session.SenderAddrs, session.QUICPort, 2*time.Second); err == nil {
+			return session, conn, conn.(*quicStream).openStream, true
+		}
+	}
 
-	_, err := conn.Write([]byte("ready\n"))
+	conn, err := dialEndpoint(*session, 2*time.Second)
 	if err != nil {
-		return FileMetadata{}, fmt.Errorf("failed to send ready signal: %v", err)
+		return nil, nil, nil, false
 	}
+	return session, conn, dialTCP(conn.RemoteAddr().String()), true
+}
 
-	fileInfo, err := reader.ReadString('\n')
+// Transport names the protocol the connection runs over: "quic", "webrtc",
+// "udp" for QUIC on a hole-punched socket, or "tcp".
+func (rc *ReceiverConn) Transport() string {
+	return rc.transport
+}
+
+// connectPeer reaches the peer that opened session over QUIC, a WebRTC data
+// channel or a hole punched through both NATs when both sides offer it,
+// directly over TCP when one of its published addresses answers, and
+// through the relay pipe otherwise. The
+// returned dial opens further connections to it the same way.
+func connectPeer(session TransferSession, role Role) (net.Conn, streamFunc, error) {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return DialRelayPipe(ctx, session.SessionID, string(role))
+	}
+
+	if QUIC && session.QUICPort != "" {
+		if conn, err := dialQUIC(session.SenderAddrs, session.QUICPort, 2*time.Second); err == nil {
+			return conn, conn.(*quicStream).openStream, nil
+		}
+	}
+
+	// A direct connection needs no relay round trips, so it goes ahead of
+	// the transports that get through NATs.
+	conn, err := dialEndpoint(session, 2*time.Second)
+	if err == nil {
+		return conn, dialTCP(conn.RemoteAddr().String()), nil
+	}
+
+	peer := RoleSender
+	if role == RoleSender {
+		peer = RoleReceiver
+	}
+
+	if WEBRTC && session.WebRTC {
+		if conn, err := dialWebRTC(currentPeerSettings(), session.SessionID, string(peer)); err == nil {
+			return conn, conn.(*webrtcConn).openStream, nil
+		}
+	}
+
+	if PUNCH && session.Punch {
+		if conn, err := dialPunched(currentPeerSettings(), session.SessionID, role); err == nil {
+			return conn, conn.(*quicStream).openStream, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err = dial(ctx)
 	if err != nil {
-		return FileMetadata{}, fmt.Errorf("failed to read file info: %v", err)
+		return nil, nil, fmt.Errorf("couldn't connect to %s - are they still online? (%v)", peer, err.Error())
+	}
+	return conn, dial, nil
+}
+
+// dialTCP opens further connections to the peer at addr.
+func dialTCP(addr string) streamFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		timeout := 10 * time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		return DialTCP(addr, timeout)
+	}
+}
+
+// DialTCP opens direct connections to the peer, the first one at its
+// published address. Tests replace it to stand for a network that blocks
+// them.
+var DialTCP = func(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func dialEndpoint(session TransferSession, timeout time.Duration) (net.Conn, error) {
+	if len(session.SenderAddrs) == 0 || session.SenderPort == "" {
+		return nil, fmt.Errorf("session has no published address")
 	}
 
-	parts := strings.Split(strings.TrimSpace(fileInfo), "|")
-	if len(parts) != 2 {
-		return FileMetadata{}, fmt.Errorf("invalid file info: %s", fileInfo)
+	var lastErr error
+	for _, addr := range session.SenderAddrs {
+		conn, err := DialTCP(net.JoinHostPort(addr, session.SenderPort), timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return conn, nil
 	}
+	return nil, lastErr
+}
+
+func ReceiveMetadata(conn *ReceiverConn) (FileMetadata, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-	filesize, err := strconv.ParseInt(parts[1], 10, 64)
+	frame, err := conn.ReadFrame()
 	if err != nil {
-		return FileMetadata{}, fmt.Errorf("failed to parse file size: %v %s", err, parts[1])
+		return FileMetadata{}, fmt.Errorf("failed to read file info: %v", err)
+	}
+	offer, err := readOffer(conn.Conn, frame)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	if len(offer.Files) == 0 {
+		return FileMetadata{}, fmt.Errorf("sender offered no files")
 	}
+
+	seen := make(map[string]bool, len(offer.Files))
+	for i, f := range offer.Files {
+		name, err := sanitizeName(f.Name)
+		if err == nil && seen[name] {
+			err = ErrUnsafePath
+		}
+		if err != nil {
+			sendError(conn.Conn, ErrUnsafePath)
+			return FileMetadata{}, fmt.Errorf("sender offered an unsafe file name %q", f.Name)
+		}
+		seen[name] = true
+		offer.Files[i].Name = name
+	}
+
 	metadata := FileMetadata{
-		Name:     parts[0],
-		Size:     filesize,
+		Files:    offer.Files,
 		SenderIP: conn.RemoteAddr().String(),
 	}
 
+	var roots []string
+	for _, f := range offer.Files {
+		metadata.Size += f.Size
+		root, _, _ := strings.Cut(f.Name, "/")
+		if !slices.Contains(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+
+	metadata.Name = roots[0]
+	if len(roots) > 1 {
+		metadata.Name = fmt.Sprintf("%d items", len(roots))
+	} else if len(offer.Files) > 1 {
+		metadata.Name += "/"
+	}
+
 	return metadata, nil
 }
 
-func ReceiveFile(conn net.Conn, m FileMetadata, progressChan chan<- ReceiveProgress, ctx context.Context) {
+func RejectTransfer(conn *ReceiverConn) error {
+	defer conn.Close()
+	return conn.Send(protocol.MsgReject, protocol.Reject{
+		Code:    ErrTransferRejected.Code,
+		Message: ErrTransferRejected.Message,
+	})
+}
+
+func ReceiveFile(rc *ReceiverConn, m FileMetadata, dir string, conflicts Conflicts, limiter *Limiter, progressChan chan<- ReceiveProgress, ctx context.Context) {
+	conn := rc.Conn
 	go func() {
 		defer close(progressChan)
 		defer conn.Close()
@@ -127,85 +369,549 @@ func ReceiveFile(conn net.Conn, m FileMetadata, progressChan chan<- ReceiveProgr
 
 		progressChan <- ReceiveProgress{State: StateInitializing}
 
-		reader := bufio.NewReader(conn)
-		conn.Write([]byte("accepted\n"))
+		b := &batchReceiver{
+			ctx:          ctx,
+			limiter:      limiter,
+			conn:         conn,
+			code:         rc.code,
+			dial:         rc.dial,
+			progressChan: progressChan,
+			files:        m.Files,
+			names:        make([]string, len(m.Files)),
+			offsets:      make([]int64, len(m.Files)),
+			policies:     make([]ConflictPolicy, len(m.Files)),
+			existing:     make([]bool, len(m.Files)),
+			outcomes:     make([]FileOutcome, len(m.Files)),
+			compressors:  make(map[string]compressor),
+			index:        -1,
+		}
 
-		safeName := m.Name
+		if dir == "" {
+			dir = "."
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			sendError(conn, ErrWriteFailed)
+			progressChan <- ReceiveProgress{
+				Error: fmt.Errorf("destination '%s' is not a directory", dir),
+				State: StateError,
+			}
+			return
+		}
 
-		if _, err := os.Stat(safeName); err == nil {
-			safeName = fmt.Sprintf("%s_%d%s",
-				strings.TrimSuffix(m.Name, filepath.Ext(m.Name)),
-				time.Now().Unix(),
-				filepath.Ext(m.Name),
-			)
+		if err := b.resolveNames(dir); err != nil {
+			sendError(conn, ErrUnsafePath)
+			progressChan <- ReceiveProgress{
+				Error: err,
+				State: StateError,
+			}
+			return
 		}
+		b.cleanStaleParts(dir)
 
-		file, err := os.Create(safeName)
-		if err != nil {
+		accept := make([]protocol.FileAccept, len(m.Files))
+		for i, f := range m.Files {
+			if !f.Dir && conn.Supports(protocol.CapResume) {
+				b.offsets[i] = resumeOffset(b.names[i], f)
+			}
+			if !f.Dir && b.offsets[i] == 0 {
+				accept[i].Skip, accept[i].Prefix = b.resolveConflict(i, conflicts.policy(i))
+			}
+			accept[i].Offset = b.offsets[i]
+			b.outcomes[i] = FileOutcome{Name: b.names[i], Size: f.Size, Skipped: accept[i].Skip}
+			if accept[i].Skip {
+				continue
+			}
+			b.totalBytes += f.Size
+			b.resumedBytes += b.offsets[i]
+		}
+		b.receivedBytes = b.resumedBytes
+
+		if free, err := freeSpace(dir); err == nil && b.totalBytes-b.resumedBytes > free {
+			conn.Send(protocol.MsgReject, protocol.Reject{
+				Code:    ErrInsufficientSpace.Code,
+				Message: ErrInsufficientSpace.Message,
+			})
 			progressChan <- ReceiveProgress{
-				Error: fmt.Errorf("failed to create file '%s': %v", safeName, err),
+				Error: fmt.Errorf("not enough free space in '%s': %d bytes needed, %d available", dir, b.totalBytes-b.resumedBytes, free),
 				State: StateError,
 			}
 			return
 		}
-		defer file.Close()
 
-		buffer := make([]byte, CHUNK_SIZE)
-		var receivedBytes int64
-		startTime := time.Now()
+		if err := b.createDirs(); err != nil {
+			sendError(conn, ErrWriteFailed)
+			progressChan <- ReceiveProgress{
+				Error: err,
+				State: StateError,
+			}
+			return
+		}
 
-		progressChan <- ReceiveProgress{State: StateReceiving}
+		if err := sendAccept(conn, accept, false); err != nil {
+			progressChan <- ReceiveProgress{
+				Error: fmt.Errorf("failed to accept transfer: %v", err),
+				State: StateError,
+			}
+			return
+		}
+
+		b.startTime = time.Now()
+		b.meter = newRateMeter()
+		progressChan <- ReceiveProgress{
+			BytesReceived: b.receivedBytes,
+			TotalBytes:    b.totalBytes,
+			State:         StateReceiving,
+		}
+
+		defer func() {
+			closeStreams(b.streams)
+		}()
 
 		for {
-			select {
-			case <-ctx.Done():
-				file.Close()
-				os.Remove(safeName)
-				progressChan <- ReceiveProgress{
-					Speed:         float64(receivedBytes) / time.Since(startTime).Seconds() / 1024 / 1024,
-					BytesReceived: receivedBytes,
-					State:         StateCancelled,
-					Error:         fmt.Errorf("transfer cancelled"),
-				}
-				return
-			default:
+			done, err := false, errCancelled
+			if ctx.Err() == nil {
+				done, err = b.next()
 			}
 
-			n, err := reader.Read(buffer)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
+			switch {
+			case done:
+				b.finish()
+				return
+			case err == errCancelled:
+				conn.Send(protocol.MsgCancel, protocol.Cancel{})
+				b.cancel(err)
+				return
+			case err == errSenderCancelled:
+				b.cancel(err)
+				return
+			case err != nil:
+				b.close()
 				progressChan <- ReceiveProgress{
-					Error: fmt.Errorf("failed to read from connection: %v", err),
+					Error: err,
 					State: StateError,
 				}
 				return
 			}
+		}
+	}()
+}
 
-			_, err = file.Write(buffer[:n])
-			if err != nil {
-				progressChan <- ReceiveProgress{
-					Error: fmt.Errorf("failed to write to file '%s': %v", safeName, err),
-					State: StateError,
-				}
-				return
+func (b *batchReceiver) next() (bool, error) {
+	b.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	frame, err := b.conn.ReadFrame()
+	if err != nil {
+		return false, fmt.Errorf("failed to read from connection: %v", err)
+	}
+
+	switch frame.Type {
+	case protocol.MsgStreamOpen:
+		return false, b.openStreams(frame)
+	case protocol.MsgFileStart:
+		if err := b.startFile(frame); err != nil || !b.ranged {
+			return false, err
+		}
+		return false, b.receiveRanges()
+	case protocol.MsgData:
+		return false, b.write(frame.Payload, len(frame.Payload))
+	case protocol.MsgCompressed:
+		return false, b.writeCompressed(frame.Payload)
+	case protocol.MsgFileDone:
+		return false, b.finishFile(frame)
+	case protocol.MsgDone:
+		return true, nil
+	case protocol.MsgCancel:
+		return false, errSenderCancelled
+	default:
+		return false, remoteError(frame)
+	}
+}
+
+func (b *batchReceiver) cancel(err error) {
+	b.abort()
+	b.progressChan <- ReceiveProgress{
+		Speed:         b.speed(),
+		BytesReceived: b.receivedBytes,
+		TotalBytes:    b.totalBytes,
+		Files:         b.outcomes,
+		State:         StateCancelled,
+		Error:         err,
+	}
+}
+
+func (b *batchReceiver) speed() float64 {
+	return float64(b.receivedBytes-b.resumedBytes) / time.Since(b.startTime).Seconds() / 1024 / 1024
+}
+
+func (b *batchReceiver) wireSpeed() float64 {
+	return float64(b.wireBytes) / time.Since(b.startTime).Seconds() / 1024 / 1024
+}
+
+func (b *batchReceiver) startFile(frame protocol.Frame) error {
+	var start protocol.FileStart
+	if err := frame.Decode(&start); err != nil {
+		return err
+	}
+	if b.file != nil || start.Index < 0 || start.Index >= len(b.files) || b.files[start.Index].Dir || b.outcomes[start.Index].Skipped {
+		sendError(b.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender started an unexpected file")
+	}
+
+	var codec compressor
+	if start.Compression != "" {
+		if !b.conn.Supports(start.Compression) {
+			sendError(b.conn, ErrUnexpectedMessage)
+			return fmt.Errorf("sender used compression '%s' that was not negotiated", start.Compression)
+		}
+
+		codec = b.compressors[start.Compression]
+		if codec == nil {
+			var err error
+			if codec, err = newCompressor(start.Compression); err != nil {
+				sendError(b.conn, ErrUnexpectedMessage)
+				return err
 			}
+			b.compressors[start.Compression] = codec
+		}
+	}
 
-			receivedBytes += int64(n)
-			speed := float64(receivedBytes) / time.Since(startTime).Seconds() / 1024 / 1024
+	if start.Restart {
+		if !b.existing[start.Index] {
+			sendError(b.conn, ErrUnexpectedMessage)
+			return fmt.Errorf("sender restarted a file that was not resumed")
+		}
+		// The file at the destination only shares its head with the one
+		// sent, so it is kept and the whole file saved next to it.
+		b.resumedBytes -= b.offsets[start.Index]
+		b.receivedBytes -= b.offsets[start.Index]
+		b.offsets[start.Index] = 0
+		b.existing[start.Index] = false
+		b.policies[start.Index] = ConflictRename
+	}
 
-			progressChan <- ReceiveProgress{
-				Speed:         speed,
-				BytesReceived: receivedBytes,
-				State:         StateReceiving,
+	entry, name := b.files[start.Index], b.names[start.Index]
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		sendError(b.conn, ErrWriteFailed)
+		return fmt.Errorf("failed to create directory '%s': %v", filepath.Dir(name), err)
+	}
+
+	if b.existing[start.Index] {
+		if err := os.Rename(name, partPath(name)); err != nil {
+			sendError(b.conn, ErrWriteFailed)
+			return fmt.Errorf("failed to reopen existing file '%s': %v", name, err)
+		}
+		writeSidecar(name, entry)
+	}
+
+	file, hash, err := openPartial(name, entry, b.offsets[start.Index])
+	if err != nil {
+		if b.existing[start.Index] {
+			restoreExisting(name, b.offsets[start.Index])
+		}
+		sendError(b.conn, ErrWriteFailed)
+		return fmt.Errorf("failed to create file '%s': %v", partPath(name), err)
+	}
+
+	if err := preallocate(file, entry.Size); err != nil {
+		file.Close()
+		if b.existing[start.Index] {
+			restoreExisting(name, b.offsets[start.Index])
+		} else if b.offsets[start.Index] == 0 {
+			discardPartial(name)
+		}
+		sendError(b.conn, ErrInsufficientSpace)
+		return fmt.Errorf("failed to allocate space for '%s': %v", name, err)
+	}
+
+	b.ranged = start.Streams > 0
+	if b.ranged {
+		if start.Streams != 1+len(b.streams) {
+			file.Close()
+			sendError(b.conn, ErrUnexpectedMessage)
+			return fmt.Errorf("sender used %d streams but %d were opened", start.Streams, 1+len(b.streams))
+		}
+		b.ranges = nil
+		b.hashed = newRangeHash(hash, file, b.offsets[start.Index])
+		// Ranges leave holes until every one arrived, so the part must not be
+		// resumed from; a sidecar that no longer matches the entry still marks
+		// it as ours to clean up.
+		writeSidecar(name, protocol.FileEntry{Name: entry.Name})
+	}
+
+	b.index = start.Index
+	b.file = file
+	b.hash = hash
+	b.fileBytes = b.offsets[start.Index]
+	b.codec = codec
+	b.compression = start.Compression
+	return nil
+}
+
+func (b *batchReceiver) writeCompressed(payload []byte) error {
+	if b.file == nil || b.codec == nil {
+		sendError(b.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender sent compressed data outside of a compressed file")
+	}
+
+	data, err := b.codec.decompress(payload)
+	if err != nil {
+		sendError(b.conn, ErrCorruptData)
+		return fmt.Errorf("failed to decompress data for '%s': %v", b.files[b.index].Name, err)
+	}
+	return b.write(data, len(payload))
+}
+
+func (b *batchReceiver) write(data []byte, wireSize int) error {
+	if b.file == nil {
+		sendError(b.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender sent data outside of a file")
+	}
+
+	entry := b.files[b.index]
+	if !entry.Stream && b.fileBytes+int64(len(data)) > entry.Size {
+		sendError(b.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender sent more data than announced for '%s'", entry.Name)
+	}
+	if err := throttle(b.ctx, b.limiter, wireSize); err != nil {
+		return err
+	}
+
+	b.hash.Write(data)
+
+	if _, err := b.file.Write(data); err != nil {
+		sendError(b.conn, ErrWriteFailed)
+		return fmt.Errorf("failed to write to file '%s': %v", partPath(b.names[b.index]), err)
+	}
+
+	b.advance(len(data), wireSize)
+	return nil
+}
+
+func (b *batchReceiver) advance(logical, wire int) {
+	entry := b.files[b.index]
+	b.fileBytes += int64(logical)
+	b.receivedBytes += int64(logical)
+	b.wireBytes += int64(wire)
+	speed, wireSpeed := b.meter.add(logical, wire)
+
+	b.progressChan <- ReceiveProgress{
+		Speed:         speed,
+		WireSpeed:     wireSpeed,
+		BytesReceived: b.receivedBytes,
+		TotalBytes:    b.totalBytes,
+		WireBytes:     b.wireBytes,
+		Streams:       1 + len(b.streams),
+		FileIndex:     b.index,
+		FileName:      entry.Name,
+		FileBytes:     b.fileBytes,
+		FileSize:      entry.Size,
+		State:         StateReceiving,
+	}
+}
+
+func (b *batchReceiver) finishFile(frame protocol.Frame) error {
+	var done protocol.FileDone
+	if err := frame.Decode(&done); err != nil {
+		return err
+	}
+	if b.file == nil || done.Index != b.index {
+		sendError(b.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender finished an unexpected file")
+	}
+
+	entry, name := b.files[b.index], b.names[b.index]
+	checksum := hex.EncodeToString(b.hash.Sum(nil))
+	syncErr := b.file.Sync()
+	b.file.Close()
+	b.file = nil
+
+	outcome := &b.outcomes[b.index]
+	outcome.Checksum = checksum
+	if entry.Stream {
+		outcome.Size = b.fileBytes
+	}
+
+	switch {
+	case !entry.Stream && b.fileBytes != entry.Size:
+		outcome.Error = ErrIncompleteFile
+	case syncErr != nil:
+		outcome.Error = ErrWriteFailed
+	case b.conn.Supports(protocol.CapSHA256) && done.Checksum != checksum:
+		outcome.Error = ErrChecksumMismatch
+	}
+	if outcome.Error != nil {
+		if b.existing[b.index] {
+			restoreExisting(name, b.offsets[b.index])
+		} else {
+			discardPartial(name)
+		}
+		b.fail(outcome.Error)
+		return nil
+	}
+
+	finalName := name
+	if _, err := os.Lstat(finalName); err == nil && b.policies[b.index] != ConflictOverwrite {
+		finalName = availableName(name)
+	}
+
+	if entry.Mode != 0 {
+		os.Chmod(partPath(name), os.FileMode(entry.Mode).Perm())
+	}
+	if err := finishPartial(name, finalName); err != nil {
+		outcome.Error = ErrWriteFailed
+		b.fail(outcome.Error)
+		return nil
+	}
+
+	outcome.Name = finalName
+	return nil
+}
+
+func (b *batchReceiver) fail(err error) {
+	result := protocol.FileResult{Index: b.index, Message: err.Error()}
+	if sessionErr, ok := err.(SessionError); ok {
+		result.Code = sessionErr.Code
+		result.Message = sessionErr.Message
+	}
+	b.results = append(b.results, result)
+}
+
+func (b *batchReceiver) resolveNames(root string) error {
+	for i, f := range b.files {
+		name, err := destinationPath(root, f.Name)
+		if err != nil {
+			return err
+		}
+
+		paths := []string{name}
+		if !f.Dir {
+			paths = append(paths, partPath(name), sidecarPath(name))
+		}
+		for _, path := range paths {
+			if err := confine(root, path); err != nil {
+				return err
 			}
 		}
+		b.names[i] = name
+	}
+	return nil
+}
 
-		progressChan <- ReceiveProgress{
-			Speed:         float64(receivedBytes) / time.Since(startTime).Seconds() / 1024 / 1024,
-			BytesReceived: receivedBytes,
-			State:         StateCompleted,
+func (b *batchReceiver) cleanStaleParts(root string) {
+	dirs := map[string]bool{root: true}
+	for i, f := range b.files {
+		if !f.Dir {
+			dirs[filepath.Dir(b.names[i])] = true
 		}
-	}()
+	}
+	for dir := range dirs {
+		cleanStaleParts(dir)
+	}
+}
+
+// resolveConflict applies policy to a file already at the destination. It
+// reports whether the file is skipped and, when it is resumed, the digest of
+// the part already there.
+func (b *batchReceiver) resolveConflict(i int, policy ConflictPolicy) (bool, string) {
+	if _, err := os.Lstat(b.names[i]); err != nil {
+		return false, ""
+	}
+
+	var prefix string
+	switch policy {
+	case ConflictOverwrite:
+	case ConflictSkip:
+		if b.conn.Supports(protocol.CapSkip) {
+			b.policies[i] = policy
+			return true, ""
+		}
+		policy = ConflictRename
+	case ConflictResume:
+		offset, digest, ok := existingPrefix(b.names[i], b.files[i])
+		if !ok || !b.conn.Supports(protocol.CapResume) {
+			policy = ConflictRename
+			break
+		}
+		b.offsets[i] = offset
+		b.existing[i] = true
+		prefix = digest
+	default:
+		policy = ConflictRename
+	}
+	b.policies[i] = policy
+	return false, prefix
+}
+
+func (b *batchReceiver) createDirs() error {
+	for i, f := range b.files {
+		if !f.Dir {
+			continue
+		}
+		if err := os.MkdirAll(b.names[i], 0o755); err != nil {
+			return fmt.Errorf("failed to create directory '%s': %v", b.names[i], err)
+		}
+	}
+	return nil
+}
+
+func (b *batchReceiver) finish() {
+	b.close()
+
+	for i := len(b.files) - 1; i >= 0; i-- {
+		if b.files[i].Dir && b.files[i].Mode != 0 {
+			os.Chmod(b.names[i], os.FileMode(b.files[i].Mode).Perm())
+		}
+	}
+	b.conn.Send(protocol.MsgDone, protocol.Done{Results: b.results})
+
+	var firstErr error
+	for _, outcome := range b.outcomes {
+		if outcome.Error != nil {
+			firstErr = outcome.Error
+			break
+		}
+	}
+
+	state := StateCompleted
+	if firstErr != nil {
+		state = StateError
+	}
+
+	b.progressChan <- ReceiveProgress{
+		Speed:         b.speed(),
+		WireSpeed:     b.wireSpeed(),
+		BytesReceived: b.receivedBytes,
+		TotalBytes:    b.totalBytes,
+		WireBytes:     b.wireBytes,
+		Files:         b.outcomes,
+		Error:         firstErr,
+		State:         state,
+	}
+}
+
+func (b *batchReceiver) close() {
+	if b.file == nil {
+		return
+	}
+
+	existing := b.existing[b.index]
+	if b.ranged && !existing {
+		if err := b.file.Truncate(b.contiguous()); err == nil {
+			writeSidecar(b.names[b.index], b.files[b.index])
+		}
+	}
+	b.file.Close()
+	b.file = nil
+	if existing {
+		restoreExisting(b.names[b.index], b.offsets[b.index])
+	}
+}
+
+func (b *batchReceiver) abort() {
+	if b.file != nil {
+		existing := b.existing[b.index]
+		b.close()
+		if !existing {
+			discardPartial(b.names[b.index])
+		}
+	}
 }
@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -21,11 +23,22 @@ type RelayServer struct {
 	Messages    []string
 	IsRunning   bool
 	mu          sync.Mutex
+	pipes       map[string]*pipeEnd
+	pipeMu      sync.Mutex
+	signals     map[string]chan []byte
+	signalMu    sync.Mutex
+	udp         net.PacketConn
+	punches     map[string]punchEntry
+	punchMu     sync.Mutex
+	sessionMu   sync.Mutex
 }
 
 func NewRelayServer() *RelayServer {
 	return &RelayServer{
 		sessions:  &sync.Map{},
+		pipes:     make(map[string]*pipeEnd),
+		signals:   make(map[string]chan []byte),
+		punches:   make(map[string]punchEntry),
 		Messages:  make([]string, 0),
 		IsRunning: false,
 	}
@@ -55,14 +68,11 @@ func (s *RelayServer) Start() {
 		}
 
 		mux.HandleFunc("/new", logRequest(func(w http.ResponseWriter, r *http.Request) {
-			sessionID := GenerateID()
-			senderID := GenerateID()
-			session := &TransferSession{
-				SessionID: sessionID,
-				SenderID:  senderID,
-			}
-			s.sessions.Store(sessionID, session)
-			json.NewEncoder(w).Encode(session)
+			s.openSession(w, r, false)
+		}))
+
+		mux.HandleFunc("/request", logRequest(func(w http.ResponseWriter, r *http.Request) {
+			s.openSession(w, r, true)
 		}))
 
 		mux.HandleFunc("/join/", logRequest(func(w http.ResponseWriter, r *http.Request) {
@@ -79,13 +89,66 @@ func (s *RelayServer) Start() {
 				return
 			}
 
-			if session.(*TransferSession).ReceiverID != "" {
+			s.sessionMu.Lock()
+			defer s.sessionMu.Unlock()
+
+			joined := session.(*TransferSession)
+			if joined.Request {
+				http.Error(w, "This session is a file request", http.StatusUnprocessableEntity)
+				return
+			}
+			if joined.Multi {
+				if joined.MaxReceivers > 0 && len(joined.Receivers) >= joined.MaxReceivers {
+					http.Error(w, "This session is not accepting more receivers", http.StatusGone)
+					return
+				}
+
+				reply := *joined
+				reply.ReceiverID = GenerateID()
+				reply.Receivers = nil
+				joined.Receivers = append(joined.Receivers, reply.ReceiverID)
+				json.NewEncoder(w).Encode(reply)
+				return
+			}
+
+			if joined.ReceiverID != "" {
 				http.Error(w, "This session already has an active receiver", http.StatusConflict)
 				return
 			}
 
-			session.(*TransferSession).ReceiverID = GenerateID()
-			json.NewEncoder(w).Encode(session)
+			joined.ReceiverID = GenerateID()
+			json.NewEncoder(w).Encode(joined)
+		}))
+
+		mux.HandleFunc("/answer/", logRequest(func(w http.ResponseWriter, r *http.Request) {
+			parts := strings.Split(r.URL.Path, "/")
+			if len(parts) != 3 || parts[2] == "" {
+				http.Error(w, "Invalid session ID format", http.StatusBadRequest)
+				return
+			}
+
+			sessionID := parts[2]
+			session, exists := s.sessions.Load(sessionID)
+			if !exists {
+				http.Error(w, fmt.Sprintf("Session '%s' not found", sessionID), http.StatusNotFound)
+				return
+			}
+
+			s.sessionMu.Lock()
+			defer s.sessionMu.Unlock()
+
+			answered := session.(*TransferSession)
+			if !answered.Request {
+				http.Error(w, "This session is not a file request", http.StatusUnprocessableEntity)
+				return
+			}
+			if answered.SenderID != "" {
+				http.Error(w, "This request already has a sender", http.StatusConflict)
+				return
+			}
+
+			answered.SenderID = GenerateID()
+			json.NewEncoder(w).Encode(answered)
 		}))
 
 		mux.HandleFunc("/leave/", logRequest(func(w http.ResponseWriter, r *http.Request) {
@@ -102,13 +165,56 @@ func (s *RelayServer) Start() {
 				return
 			}
 
-			if session.(*TransferSession).ReceiverID == "" {
+			s.forgetPunches(sessionID)
+			s.forgetSignals(sessionID)
+
+			s.sessionMu.Lock()
+			defer s.sessionMu.Unlock()
+
+			left := session.(*TransferSession)
+			receiverID := r.URL.Query().Get("receiver")
+			if left.Request {
+				left.SenderID = ""
+				json.NewEncoder(w).Encode(left)
+				return
+			}
+			if left.Multi {
+				left.Receivers = slices.DeleteFunc(left.Receivers, func(id string) bool {
+					return id == receiverID
+				})
+				reply := *left
+				reply.Receivers = nil
+				json.NewEncoder(w).Encode(reply)
+				return
+			}
+
+			if left.ReceiverID == "" {
 				http.Error(w, "Session does not have a receiver", http.StatusConflict)
 				return
 			}
 
-			session.(*TransferSession).ReceiverID = ""
-			json.NewEncoder(w).Encode(session)
+			left.ReceiverID = ""
+			json.NewEncoder(w).Encode(left)
+		}))
+
+		mux.HandleFunc("/pipe/", logRequest(func(w http.ResponseWriter, r *http.Request) {
+			parts := strings.Split(r.URL.Path, "/")
+			if len(parts) != 3 || parts[2] == "" {
+				http.Error(w, "Invalid session ID format", http.StatusBadRequest)
+				return
+			}
+
+			s.handlePipe(w, r, parts[2])
+		}))
+
+		mux.HandleFunc("/signal/", logRequest(func(w http.ResponseWriter, r *http.Request) {
+			parts := strings.Split(r.URL.Path, "/")
+			if len(parts) != 3 || parts[2] == "" {
+				http.Error(w, "Invalid session ID format", http.StatusBadRequest)
+				return
+			}
+
+			s.handleSignal(w, r, parts[2])
 		}))
 
 		s.server = &http.Server{
@@ -117,6 +223,13 @@ func (s *RelayServer) Start() {
 		}
 	}
 
+	if udp, err := net.ListenPacket("udp", RELAY_SERVER); err == nil {
+		s.udp = udp
+		go s.serveRendezvous(udp)
+	} else {
+		s.logChan <- fmt.Sprintf("Hole punching unavailable: %v", err)
+	}
+
 	go func() {
 		s.logChan <- "Starting server on port " + RELAY_SERVER
 		if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
@@ -129,6 +242,42 @@ func (s *RelayServer) Start() {
 	}()
 }
 
+// openSession registers a session for the peer that will listen for the
+// other one: a sender offering files, or a receiver requesting them.
+func (s *RelayServer) openSession(w http.ResponseWriter, r *http.Request, request bool) {
+	var endpoint TransferSession
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&endpoint); err != nil {
+			http.Error(w, "Invalid session data", http.StatusBadRequest)
+			return
+		}
+	}
+
+	addrs := endpoint.SenderAddrs
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && !slices.Contains(addrs, host) {
+		addrs = append(addrs, host)
+	}
+
+	session := &TransferSession{
+		SessionID:   GenerateID(),
+		SenderAddrs: addrs,
+		SenderPort:  endpoint.SenderPort,
+		QUICPort:    endpoint.QUICPort,
+		WebRTC:      endpoint.WebRTC,
+		Punch:       endpoint.Punch,
+	}
+	if request {
+		session.ReceiverID = GenerateID()
+		session.Request = true
+	} else {
+		session.SenderID = GenerateID()
+		session.Multi = endpoint.Multi
+		session.MaxReceivers = endpoint.MaxReceivers
+	}
+	s.sessions.Store(session.SessionID, session)
+	json.NewEncoder(w).Encode(session)
+}
+
 func (s *RelayServer) Stop() {
 	s.mu.Lock()
 	if !s.IsRunning {
@@ -149,6 +298,12 @@ func (s *RelayServer) Stop() {
 		}
 	}
 
+	if s.udp != nil {
+		s.udp.Close()
+		s.udp = nil
+	}
+
+	s.closePipes()
 	s.server = nil
 	close(s.logChan)
 }
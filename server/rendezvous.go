@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Peers keep registering while they look for each other, so a registration
+// older than this belongs to a peer that already connected or gave up.
+const rendezvousFresh = 2 * time.Second
+
+// rendezvous is what a peer sends the relay's UDP port while it looks for
+// the other side of a session to punch a hole through to.
+type rendezvous struct {
+	Session string   `json:"session"`
+	Role    Role     `json:"role"`
+	Local   []string `json:"local,omitempty"`
+}
+
+// rendezvousReply reports the address the relay saw a registration come
+// from and, once the other side registered too, that side's candidates.
+type rendezvousReply struct {
+	Observed string   `json:"observed,omitempty"`
+	Peer     []string `json:"peer,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type punchEntry struct {
+	candidates []string
+	seen       time.Time
+}
+
+// serveRendezvous answers registrations on the relay's UDP port. Each one
+// records the address the packet came from, which is the peer's mapping on
+// its NAT, ahead of the addresses the peer found locally.
+func (s *RelayServer) serveRendezvous(udp net.PacketConn) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var req rendezvous
+		if err := json.Unmarshal(buf[:n], &req); err != nil || (req.Role != RoleSender && req.Role != RoleReceiver) {
+			continue
+		}
+
+		var reply rendezvousReply
+		if _, exists := s.sessions.Load(req.Session); !exists {
+			reply.Error = ErrSessionNotFound.Code
+		} else {
+			reply.Observed = addr.String()
+			reply.Peer = s.register(req, reply.Observed)
+		}
+
+		if data, err := json.Marshal(reply); err == nil {
+			udp.WriteTo(data, addr)
+		}
+	}
+}
+
+// register stores the candidates of req's side and returns the other side's,
+// if it registered recently. Registrations that went stale are swept out on
+// the way.
+func (s *RelayServer) register(req rendezvous, observed string) []string {
+	peer := RoleSender
+	if req.Role == RoleSender {
+		peer = RoleReceiver
+	}
+
+	s.punchMu.Lock()
+	defer s.punchMu.Unlock()
+
+	for key, entry := range s.punches {
+		if time.Since(entry.seen) > rendezvousFresh {
+			delete(s.punches, key)
+		}
+	}
+	s.punches[req.Session+"/"+string(req.Role)] = punchEntry{
+		candidates: append([]string{observed}, req.Local...),
+		seen:       time.Now(),
+	}
+
+	entry, exists := s.punches[req.Session+"/"+string(peer)]
+	if !exists {
+		return nil
+	}
+	return entry.candidates
+}
+
+// forgetPunches drops the registrations of both sides of a session.
+func (s *RelayServer) forgetPunches(sessionID string) {
+	s.punchMu.Lock()
+	defer s.punchMu.Unlock()
+	delete(s.punches, sessionID+"/"+string(RoleSender))
+	delete(s.punches, sessionID+"/"+string(RoleReceiver))
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"ft_0/protocol"
+	"net"
+	"time"
+)
+
+// FileRequest is a session opened by a receiver asking for files. Its code
+// is shared with the sender, who answers it with StartRequestSender.
+type FileRequest struct {
+	Code       string
+	SessionID  string
+	receiverID string
+	listener   *transferListener
+}
+
+// CreateRequest opens a request session and starts listening for the
+// sender that answers it.
+func CreateRequest(ctx context.Context) (*FileRequest, error) {
+	listener, endpoint, err := listenTransfer()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := NewSessionManager().Open(ctx, RoleReceiver, endpoint)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	listener.rendezvous(session.SessionID, RoleReceiver)
+
+	return &FileRequest{
+		Code:       GenerateCode(session.SessionID),
+		SessionID:  session.SessionID,
+		receiverID: session.ReceiverID,
+		listener:   listener,
+	}, nil
+}
+
+// Wait blocks until the sender connects and returns the connection its
+// offer arrives on, to be read with ReceiveMetadata as after StartReceiver.
+// A request is answered once, so Wait closes the listener when it returns.
+// Transfers into a request use a single connection.
+func (r *FileRequest) Wait(ctx context.Context) (*ReceiverConn, error) {
+	defer r.listener.Close()
+
+	conn, err := waitForPeer(ctx, r.listener, r.SessionID, RoleReceiver, NewConnectionManager())
+	if err != nil {
+		return nil, err
+	}
+
+	pc := protocol.NewConn(conn)
+	pc.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := secureHandshake(pc, r.Code, true); err != nil {
+		pc.Close()
+		if err == ErrWrongCode || err == ErrIncompatibleVersion {
+			return nil, err
+		}
+		return nil, fmt.Errorf("handshake with sender failed: %v", err)
+	}
+
+	return &ReceiverConn{Conn: pc, code: r.Code, sessionID: r.SessionID, receiverID: r.receiverID, transport: transportOf(conn)}, nil
+}
+
+// Close withdraws a request that is no longer being waited on.
+func (r *FileRequest) Close() error {
+	return r.listener.Close()
+}
+
+// StartRequestSender answers the request behind code by connecting to its
+// receiver and offering paths, reporting progress as StartSender does.
+func StartRequestSender(code string, paths []string, limiter *Limiter, progressChan chan<- SendProgress, ctx context.Context) {
+	go func() {
+		defer close(progressChan)
+
+		if err := validateFiles(paths); err != nil {
+			progressChan <- SendProgress{
+				State: StateError,
+				Error: err,
+			}
+			return
+		}
+
+		progressChan <- SendProgress{State: StateInitializing}
+
+		conn, sessionID, err := answerRequest(ctx, code)
+		if err != nil {
+			progressChan <- SendProgress{
+				State: StateError,
+				Error: err,
+			}
+			return
+		}
+
+		progressChan <- SendProgress{
+			State:     StateWaitingForReceiver,
+			SessionID: sessionID,
+			Code:      code,
+		}
+
+		prepare := func() ([]outgoingFile, error) {
+			return prepareFiles(paths)
+		}
+		if _, resumable := sendFiles(prepare, code, conn, nil, nil, limiter, progressChan, ctx); resumable {
+			progressChan <- SendProgress{
+				State: StateError,
+				Error: fmt.Errorf("connection lost - ask the receiver for a new request code"),
+			}
+		}
+	}()
+}
+
+func answerRequest(ctx context.Context, code string) (net.Conn, string, error) {
+	sessionID, _, err := SplitCode(code)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session, err := NewSessionManager().Join(ctx, RoleSender, sessionID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, _, err := connectPeer(*session, RoleSender)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, sessionID, nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"ft_0/protocol"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const headSize = 64 * 1024
+
+// partPath names the hidden file that collects data next to name until it has
+// been verified, so nothing watching the folder sees a partial file.
+func partPath(name string) string {
+	return filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".part")
+}
+
+func sidecarPath(name string) string {
+	return partPath(name) + ".json"
+}
+
+// isSidecar reports whether name looks like a sidecar written by writeSidecar.
+func isSidecar(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".part.json")
+}
+
+func headHash(file io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, min(size, headSize))); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func resumeOffset(name string, entry protocol.FileEntry) int64 {
+	if entry.Head == "" {
+		return 0
+	}
+
+	data, err := os.ReadFile(sidecarPath(name))
+	if err != nil {
+		return 0
+	}
+
+	var existing protocol.FileEntry
+	if err := json.Unmarshal(data, &existing); err != nil || existing != entry {
+		return 0
+	}
+
+	info, err := os.Stat(partPath(name))
+	if err != nil {
+		return 0
+	}
+	return min(info.Size(), entry.Size)
+}
+
+func openPartial(name string, entry protocol.FileEntry, offset int64) (*os.File, hash.Hash, error) {
+	h := sha256.New()
+
+	if offset > 0 {
+		file, err := os.OpenFile(partPath(name), os.O_RDWR, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		n, err := io.Copy(h, io.LimitReader(file, offset))
+		if err == nil && n != offset {
+			err = fmt.Errorf("partial file is shorter than expected")
+		}
+		if err == nil {
+			err = file.Truncate(offset)
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return file, h, nil
+	}
+
+	file, err := os.Create(partPath(name))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeSidecar(name, entry); err != nil {
+		file.Close()
+		os.Remove(partPath(name))
+		return nil, nil, err
+	}
+
+	return file, h, nil
+}
+
+func writeSidecar(name string, entry protocol.FileEntry) error {
+	sidecar, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sidecarPath(name), sidecar, 0o644)
+}
+
+func finishPartial(name, finalName string) error {
+	if err := os.Rename(partPath(name), finalName); err != nil {
+		return err
+	}
+	os.Remove(sidecarPath(name))
+	syncDir(filepath.Dir(finalName))
+	return nil
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// CleanStaleParts sweeps dir for partial files left behind by transfers that
+// were never resumed. The app runs it at startup on the saved download folder;
+// folders below it are swept when a transfer writes to them again.
+func CleanStaleParts(dir string) {
+	if dir != "" {
+		cleanStaleParts(dir)
+	}
+}
+
+// cleanStaleParts removes partial files in dir that have not been written to
+// for PART_EXPIRY. Only a partial file with a sidecar this tool wrote next to
+// it is touched, so hidden files of other programs are left alone.
+func cleanStaleParts(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isSidecar(entry.Name()) {
+			continue
+		}
+
+		sidecar := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(sidecar)
+		if err != nil {
+			continue
+		}
+		var written protocol.FileEntry
+		if json.Unmarshal(data, &written) != nil || written.Name == "" {
+			continue
+		}
+
+		part := strings.TrimSuffix(sidecar, ".json")
+		info, err := os.Stat(part)
+		if os.IsNotExist(err) {
+			info, err = entry.Info()
+		}
+		if err == nil && time.Since(info.ModTime()) > PART_EXPIRY {
+			os.Remove(part)
+			os.Remove(sidecar)
+		}
+	}
+}
+
+func discardPartial(name string) {
+	os.Remove(partPath(name))
+	os.Remove(sidecarPath(name))
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || windows)
+
+package server
+
+import "syscall"
+
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
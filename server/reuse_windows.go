@@ -0,0 +1,19 @@
+//go:build windows
+
+package server
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_REUSEADDR, 1)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
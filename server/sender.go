@@ -1,14 +1,20 @@
 package server
 
 import (
-	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"ft_0/protocol"
+	"hash"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,15 +23,60 @@ type SendProgress struct {
 	Speed      float64
 	BytesSent  int64
 	TotalBytes int64
+	WireBytes  int64
+	WireSpeed  float64
+	Streams    int
+	FileIndex  int
+	FileCount  int
+	FileName   string
+	FileBytes  int64
+	FileSize   int64
+	Files      []FileOutcome
 	SessionID  string
+	Code       string
 	Error      error
+
+	// Receiver numbers the receivers of a multi-receiver session from 1 and
+	// is 0 for updates about the session as a whole.
+	Receiver     int
+	ReceiverAddr string
+}
+
+type outgoingFile struct {
+	path   string
+	reader io.Reader
+	entry  protocol.FileEntry
+}
+
+type batchSender struct {
+	mu           sync.Mutex
+	conn         *protocol.Conn
+	streams      []*protocol.Conn
+	progressChan chan<- SendProgress
+	ctx          context.Context
+	limiter      *Limiter
+	reply        <-chan frameResult
+	buffer       []byte
+	packed       []byte
+	compression  string
+	compressor   compressor
+	fileCount    int
+	fileBytes    int64
+	sentBytes    int64
+	totalBytes   int64
+	resumedBytes int64
+	wireBytes    int64
+	startTime    time.Time
+	meter        rateMeter
+
+	streamCompressors []compressor
 }
 
-func StartSender(filepath string, progressChan chan<- SendProgress, ctx context.Context) {
+func StartSender(paths []string, limiter *Limiter, progressChan chan<- SendProgress, ctx context.Context) {
 	go func() {
 		defer close(progressChan)
 
-		if err := validateFile(filepath); err != nil {
+		if err := validateFiles(paths); err != nil {
 			progressChan <- SendProgress{
 				State: StateError,
 				Error: err,
@@ -33,11 +84,20 @@ func StartSender(filepath string, progressChan chan<- SendProgress, ctx context.
 			return
 		}
 
-		progressChan <- SendProgress{State: StateInitializing}
+		prepare := func() ([]outgoingFile, error) {
+			return prepareFiles(paths)
+		}
+		serveSession(prepare, nil, limiter, progressChan, ctx)
+	}()
+}
+
+// StartMultiSender offers paths to every receiver that joins the session
+// until opts' limits are reached, serving each of them concurrently.
+func StartMultiSender(paths []string, opts MultiOptions, limiter *Limiter, progressChan chan<- SendProgress, ctx context.Context) {
+	go func() {
+		defer close(progressChan)
 
-		sm := NewSessionManager()
-		session, err := sm.CreateSession(ctx)
-		if err != nil {
+		if err := validateFiles(paths); err != nil {
 			progressChan <- SendProgress{
 				State: StateError,
 				Error: err,
@@ -45,13 +105,96 @@ func StartSender(filepath string, progressChan chan<- SendProgress, ctx context.
 			return
 		}
 
+		prepare := func() ([]outgoingFile, error) {
+			return prepareFiles(paths)
+		}
+		serveSession(prepare, &opts, limiter, progressChan, ctx)
+	}()
+}
+
+// StartStreamSender offers everything read from r as a single file called
+// name. Its length is not known up front, so it is sent in chunks until r
+// reports EOF and cannot be resumed if the connection drops.
+func StartStreamSender(name string, r io.Reader, limiter *Limiter, progressChan chan<- SendProgress, ctx context.Context) {
+	go func() {
+		defer close(progressChan)
+
+		if _, err := sanitizeName(name); err != nil || strings.Contains(name, "/") {
+			progressChan <- SendProgress{
+				State: StateError,
+				Error: fmt.Errorf("invalid stream name '%s'", name),
+			}
+			return
+		}
+
+		prepare := func() ([]outgoingFile, error) {
+			return []outgoingFile{{
+				path:   name,
+				reader: r,
+				entry:  protocol.FileEntry{Name: name, Stream: true},
+			}}, nil
+		}
+		serveSession(prepare, nil, limiter, progressChan, ctx)
+	}()
+}
+
+func serveSession(prepare func() ([]outgoingFile, error), multi *MultiOptions, limiter *Limiter, progressChan chan<- SendProgress, ctx context.Context) {
+	progressChan <- SendProgress{State: StateInitializing}
+
+	listener, endpoint, err := listenTransfer()
+	if err != nil {
+		progressChan <- SendProgress{
+			State: StateError,
+			Error: err,
+		}
+		return
+	}
+	defer listener.Close()
+
+	if multi != nil {
+		endpoint.Multi = true
+		endpoint.MaxReceivers = multi.MaxReceivers
+	}
+
+	sm := NewSessionManager()
+	session, err := sm.Open(ctx, RoleSender, endpoint)
+	switch {
+	case err == nil:
+		listener.rendezvous(session.SessionID, RoleSender)
+	case DISCOVERY && errors.Is(err, ErrRelayServerDown):
+		// Receivers on the local network can still find the session.
+		session = &TransferSession{SessionID: GenerateID()}
+	default:
 		progressChan <- SendProgress{
-			State:     StateWaitingForReceiver,
-			SessionID: session.SessionID,
+			State: StateError,
+			Error: err,
 		}
+		return
+	}
+	if DISCOVERY {
+		endpoint.SessionID = session.SessionID
+		listener.advertise(endpoint)
+	}
+
+	code := GenerateCode(session.SessionID)
+	if multi != nil {
+		code = generateLongCode(session.SessionID)
+	}
 
-		cm := NewConnectionManager()
-		conn, err := waitForReceiver(ctx, cm)
+	progressChan <- SendProgress{
+		State:     StateWaitingForReceiver,
+		SessionID: session.SessionID,
+		Code:      code,
+	}
+
+	if multi != nil {
+		serveReceivers(prepare, listener, session.SessionID, code, *multi, limiter, progressChan, ctx)
+		return
+	}
+
+	cm := NewConnectionManager()
+	for {
+		conn, err := waitForPeer(ctx, listener, session.SessionID, RoleSender, cm)
 		if err != nil {
 			progressChan <- SendProgress{
 				State: StateError,
@@ -60,26 +203,167 @@ func StartSender(filepath string, progressChan chan<- SendProgress, ctx context.
 			return
 		}
 
-		sendFile(filepath, conn, progressChan, ctx)
-	}()
+		acceptStream := func(ctx context.Context) (net.Conn, error) {
+			conn, err := waitForPeer(ctx, listener, session.SessionID, RoleSender, cm)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+		switch stream := conn.Conn.(type) {
+		case *quicStream:
+			acceptStream = stream.acceptStream
+		case *webrtcConn:
+			acceptStream = stream.acceptStream
+		}
+
+		interrupted, resumable := sendFiles(prepare, code, conn, acceptStream, nil, limiter, progressChan, ctx)
+		if !resumable {
+			return
+		}
+
+		sm.LeaveSession(ctx, session.SessionID)
+		interrupted.State = StateWaitingForReceiver
+		interrupted.SessionID = session.SessionID
+		interrupted.Code = code
+		progressChan <- interrupted
+	}
 }
 
 func validateFile(filepath string) error {
-	if _, err := os.Stat(filepath); os.IsNotExist(err) {
+	info, err := os.Stat(filepath)
+	if os.IsNotExist(err) {
 		return fmt.Errorf("failed to access file '%s': file does not exist", filepath)
 	}
+	if err != nil {
+		return fmt.Errorf("failed to access file '%s': %v", filepath, err)
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return fmt.Errorf("failed to access file '%s': not a regular file", filepath)
+	}
+	return nil
+}
+
+func validateFiles(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no files selected")
+	}
+
+	names := make(map[string]bool)
+	for _, path := range paths {
+		if err := validateFile(path); err != nil {
+			return err
+		}
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("failed to access file '%s': %v", path, err)
+		}
+
+		name := filepath.Base(abs)
+		if names[name] {
+			return fmt.Errorf("cannot send two files named '%s' in one batch", name)
+		}
+		names[name] = true
+	}
 	return nil
 }
 
-func waitForReceiver(ctx context.Context, cm *ConnectionManager) (*Connection, error) {
-	listener, err := net.Listen("tcp", ":"+TRANSFER_PORT)
+func prepareFiles(paths []string) ([]outgoingFile, error) {
+	var files []outgoingFile
+	for _, root := range paths {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to access file '%s': %v", root, err)
+		}
+
+		// WalkDir does not follow a symlinked root, so walk what it points to
+		// while still offering it under the name that was picked. Links found
+		// inside a folder are left out.
+		base := filepath.Base(abs)
+		resolved, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to access file '%s': %w", root, err)
+		}
+		err = filepath.WalkDir(resolved, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("failed to access file '%s': %w", path, err)
+			}
+
+			rel, err := filepath.Rel(resolved, path)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(filepath.Join(base, rel))
+
+			info, err := d.Info()
+			if err != nil {
+				return fmt.Errorf("failed to get file info for '%s': %v", path, err)
+			}
+
+			switch {
+			case d.IsDir():
+				files = append(files, outgoingFile{
+					path: path,
+					entry: protocol.FileEntry{
+						Name: name,
+						Mode: uint32(info.Mode().Perm()),
+						Dir:  true,
+					},
+				})
+			case info.Mode().IsRegular():
+				f, err := prepareFile(path, name, info)
+				if err != nil {
+					return err
+				}
+				files = append(files, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func prepareFile(path, name string, info fs.FileInfo) (outgoingFile, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to start listener: %v", err)
+		return outgoingFile{}, fmt.Errorf("failed to access file '%s': %w", path, err)
 	}
-	defer listener.Close()
+	defer file.Close()
+
+	head, err := headHash(file, info.Size())
+	if err != nil {
+		return outgoingFile{}, fmt.Errorf("error reading file '%s': %v", path, err)
+	}
+
+	return outgoingFile{
+		path: path,
+		entry: protocol.FileEntry{
+			Name:    name,
+			Size:    info.Size(),
+			Mode:    uint32(info.Mode().Perm()),
+			ModTime: info.ModTime().UnixNano(),
+			Head:    head,
+		},
+	}, nil
+}
+
+// waitForPeer returns the first connection from the peer that joined
+// sessionID, accepted on listener or through the relay pipe, where this side
+// plays role.
+func waitForPeer(ctx context.Context, listener net.Listener, sessionID string, role Role, cm *ConnectionManager) (*Connection, error) {
+	waitCtx, cancel := context.WithCancel(ctx)
+	pipeDone := make(chan struct{})
+	defer func() {
+		cancel()
+		<-pipeDone
+	}()
 
 	connChan := make(chan net.Conn)
-	errChan := make(chan error)
+	errChan := make(chan error, 1)
 
 	go func() {
 		conn, err := listener.Accept()
@@ -87,12 +371,29 @@ func waitForReceiver(ctx context.Context, cm *ConnectionManager) (*Connection, e
 			errChan <- err
 			return
 		}
-		connChan <- conn
+		select {
+		case connChan <- conn:
+		case <-waitCtx.Done():
+			conn.Close()
+		}
+	}()
+
+	go func() {
+		defer close(pipeDone)
+		conn, err := DialRelayPipe(waitCtx, sessionID, string(role))
+		if err != nil {
+			return
+		}
+		select {
+		case connChan <- conn:
+		case <-waitCtx.Done():
+			conn.Close()
+		}
 	}()
 
 	select {
 	case <-ctx.Done():
-		return nil, fmt.Errorf("transfer cancelled")
+		return nil, errCancelled
 	case err := <-errChan:
 		return nil, fmt.Errorf("failed to accept connection: %v", err)
 	case conn := <-connChan:
@@ -100,33 +401,19 @@ func waitForReceiver(ctx context.Context, cm *ConnectionManager) (*Connection, e
 	}
 }
 
-func sendFile(path string, conn net.Conn, progressChan chan<- SendProgress, ctx context.Context) {
+// sendFiles runs one transfer over conn. When admit is set it is told how
+// the code handshake went and can turn an authenticated receiver away.
+func sendFiles(prepare func() ([]outgoingFile, error), code string, conn net.Conn, acceptStream streamFunc, admit func(error) bool, limiter *Limiter, progressChan chan<- SendProgress, ctx context.Context) (SendProgress, bool) {
 	defer conn.Close()
 
-	_, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-
-	file, err := os.Open(path)
+	files, err := prepare()
 	if err != nil {
 		progressChan <- SendProgress{
 			State: StateError,
-			Error: fmt.Errorf("failed to access file '%s': %w", path, err),
+			Error: err,
 		}
-		return
+		return SendProgress{}, false
 	}
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
-	if err != nil {
-		progressChan <- SendProgress{
-			State: StateError,
-			Error: fmt.Errorf("failed to get file info for '%s': %v", path, err),
-		}
-		return
-	}
-
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer conn.SetDeadline(time.Time{})
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -137,106 +424,382 @@ func sendFile(path string, conn net.Conn, progressChan chan<- SendProgress, ctx
 		}
 	}()
 
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
+	pc := protocol.NewConn(conn)
+	pc.SetDeadline(time.Now().Add(30 * time.Second))
+
+	err = secureHandshake(pc, code, false)
+	if admit != nil && !admit(err) && err == nil {
+		sendError(pc, ErrSessionFull)
+		return SendProgress{}, false
+	}
 	if err != nil {
+		if err != ErrWrongCode && err != ErrIncompatibleVersion {
+			err = fmt.Errorf("handshake with receiver failed: %v", err)
+		}
 		progressChan <- SendProgress{
 			State: StateError,
-			Error: fmt.Errorf("error receiving ready signal: %v", err),
+			Error: err,
 		}
-		return
+		return SendProgress{}, false
+	}
+
+	entries := make([]protocol.FileEntry, len(files))
+	streamed := false
+	for i, f := range files {
+		entries[i] = f.entry
+		streamed = streamed || f.entry.Stream
 	}
 
-	if strings.TrimSpace(response) != "ready" {
+	if streamed && !pc.Supports(protocol.CapStream) {
 		progressChan <- SendProgress{
 			State: StateError,
-			Error: fmt.Errorf("unexpected response from receiver: %s", response),
+			Error: fmt.Errorf("receiver does not support streamed input"),
 		}
-		return
+		return SendProgress{}, false
 	}
 
-	metadata := fmt.Sprintf("%s|%d\n", filepath.Base(path), fileInfo.Size())
-	_, err = conn.Write([]byte(metadata))
-	if err != nil {
+	if err := sendOffer(pc, entries); err != nil {
 		progressChan <- SendProgress{
 			State: StateError,
 			Error: fmt.Errorf("failed to send metadata: %v", err),
 		}
-		return
+		return SendProgress{}, false
 	}
 
-	response, err = reader.ReadString('\n')
+	pc.SetReadDeadline(time.Now().Add(5 * time.Minute))
+	frame, err := pc.ReadFrame()
 	if err != nil {
 		progressChan <- SendProgress{
 			State: StateError,
 			Error: fmt.Errorf("error receiving response: %v", err),
 		}
-		return
+		return SendProgress{}, false
 	}
 
-	if strings.TrimSpace(response) != "accepted" {
+	switch frame.Type {
+	case protocol.MsgAccept:
+	case protocol.MsgReject:
 		progressChan <- SendProgress{
 			State: StateCancelled,
-			Error: ErrTransferRejected,
+			Error: remoteError(frame),
 		}
-		return
+		return SendProgress{}, false
+	default:
+		progressChan <- SendProgress{
+			State: StateError,
+			Error: remoteError(frame),
+		}
+		return SendProgress{}, false
+	}
+
+	accept, err := readAccept(pc, frame)
+	if err != nil || !validAccept(accept, files) {
+		progressChan <- SendProgress{
+			State: StateError,
+			Error: fmt.Errorf("receiver sent an invalid accept message"),
+		}
+		return SendProgress{}, false
+	}
+
+	pc.SetDeadline(time.Time{})
+
+	b := &batchSender{
+		conn:         pc,
+		progressChan: progressChan,
+		ctx:          ctx,
+		limiter:      limiter,
+		reply:        readFrameAsync(pc),
+		buffer:       make([]byte, CHUNK_SIZE),
+		fileCount:    len(files),
+		startTime:    time.Now(),
+		meter:        newRateMeter(),
+	}
+	for i, f := range files {
+		if accept.Files[i].Skip {
+			continue
+		}
+		b.totalBytes += f.entry.Size
+		b.sentBytes += accept.Files[i].Offset
+	}
+	b.resumedBytes = b.sentBytes
+
+	if name := negotiateCompression(pc); name != "" {
+		if compressor, err := newCompressor(name); err == nil {
+			b.compression, b.compressor = name, compressor
+		}
+	}
+
+	fail := func(err error) (SendProgress, bool) {
+		var lost connectionLost
+		switch {
+		case err == errCancelled:
+			progressChan <- SendProgress{
+				State: StateCancelled,
+				Error: err,
+			}
+		case errors.As(err, &lost) && pc.Supports(protocol.CapResume) && !streamed && ctx.Err() == nil:
+			return SendProgress{BytesSent: b.sentBytes, TotalBytes: b.totalBytes}, true
+		default:
+			progressChan <- SendProgress{
+				State: StateError,
+				Error: err,
+			}
+		}
+		return SendProgress{}, false
+	}
+
+	if pc.Streams > 1 && acceptStream != nil && !accept.Sequential && parallelCandidate(files, accept) {
+		b.streams = b.openStreams(code, pc.Streams-1, acceptStream)
+		defer closeStreams(b.streams)
 	}
 
 	progressChan <- SendProgress{
 		State:      StateTransferring,
-		TotalBytes: fileInfo.Size(),
+		BytesSent:  b.sentBytes,
+		TotalBytes: b.totalBytes,
+		Streams:    1 + len(b.streams),
 	}
 
-	buffer := make([]byte, CHUNK_SIZE)
-	var sentBytes int64
-	startTime := time.Now()
+	outcomes := make([]FileOutcome, len(files))
+	for i, f := range files {
+		if accept.Files[i].Skip {
+			outcomes[i] = FileOutcome{Name: f.entry.Name, Size: f.entry.Size, Skipped: true}
+			continue
+		}
+
+		checksum, err := b.sendEntry(i, f, accept.Files[i])
+		if err != nil {
+			return fail(err)
+		}
+		outcomes[i] = FileOutcome{
+			Name:     f.entry.Name,
+			Size:     f.entry.Size,
+			Checksum: checksum,
+		}
+	}
+
+	if err := pc.Send(protocol.MsgDone, protocol.Done{}); err != nil {
+		return fail(connectionLost{fmt.Errorf("error finishing transfer: %v", err)})
+	}
+
+	var done protocol.Done
+	select {
+	case result := <-b.reply:
+		if result.err != nil {
+			return fail(connectionLost{fmt.Errorf("error receiving confirmation: %v", result.err)})
+		}
+		if result.frame.Type != protocol.MsgDone {
+			return fail(remoteError(result.frame))
+		}
+		if err := result.frame.Decode(&done); err != nil {
+			return fail(err)
+		}
+	case <-time.After(30 * time.Second):
+		return fail(ErrConnectionTimeout)
+	}
+
+	var firstErr error
+	for _, result := range done.Results {
+		if result.Index < 0 || result.Index >= len(outcomes) || result.Code == "" {
+			continue
+		}
+		outcomes[result.Index].Error = SessionError{Code: result.Code, Message: result.Message}
+		if firstErr == nil {
+			firstErr = outcomes[result.Index].Error
+		}
+	}
+
+	state := StateCompleted
+	if firstErr != nil {
+		state = StateError
+	}
+
+	progressChan <- SendProgress{
+		State:      state,
+		BytesSent:  b.sentBytes,
+		TotalBytes: b.totalBytes,
+		WireBytes:  b.wireBytes,
+		Speed:      b.speed(),
+		WireSpeed:  b.wireSpeed(),
+		Streams:    1 + len(b.streams),
+		Files:      outcomes,
+		Error:      firstErr,
+	}
+	return SendProgress{}, false
+}
+
+func validAccept(accept protocol.Accept, files []outgoingFile) bool {
+	if len(accept.Files) != len(files) {
+		return false
+	}
+	for i, f := range accept.Files {
+		if f.Offset < 0 || f.Offset > files[i].entry.Size {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *batchSender) speed() float64 {
+	return float64(b.sentBytes-b.resumedBytes) / time.Since(b.startTime).Seconds() / 1024 / 1024
+}
+
+func (b *batchSender) wireSpeed() float64 {
+	return float64(b.wireBytes) / time.Since(b.startTime).Seconds() / 1024 / 1024
+}
+
+func (b *batchSender) advance(index int, entry protocol.FileEntry, logical, wire int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fileBytes += int64(logical)
+	b.sentBytes += int64(logical)
+	b.wireBytes += int64(wire)
+	speed, wireSpeed := b.meter.add(logical, wire)
+
+	b.progressChan <- SendProgress{
+		State:      StateTransferring,
+		Speed:      speed,
+		WireSpeed:  wireSpeed,
+		BytesSent:  b.sentBytes,
+		TotalBytes: b.totalBytes,
+		WireBytes:  b.wireBytes,
+		Streams:    1 + len(b.streams),
+		FileIndex:  index,
+		FileCount:  b.fileCount,
+		FileName:   entry.Name,
+		FileBytes:  b.fileBytes,
+		FileSize:   entry.Size,
+	}
+}
+
+func (b *batchSender) sendEntry(index int, f outgoingFile, accept protocol.FileAccept) (string, error) {
+	if f.entry.Dir {
+		return "", nil
+	}
+	offset := accept.Offset
+
+	reader := f.reader
+	var file *os.File
+	if reader == nil {
+		var err error
+		if file, err = os.Open(f.path); err != nil {
+			return "", fmt.Errorf("failed to access file '%s': %w", f.path, err)
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	start := protocol.FileStart{Index: index}
+	compressor := b.compressor
+	if compressor != nil {
+		var sample []byte
+		if file != nil {
+			sample = make([]byte, min(f.entry.Size, entropySampleSize))
+			if _, err := file.ReadAt(sample, 0); err != nil && err != io.EOF {
+				return "", fmt.Errorf("error reading file '%s': %v", f.path, err)
+			}
+		}
+		if worthCompressing(f.entry.Name, sample) {
+			start.Compression = b.compression
+		} else {
+			compressor = nil
+		}
+	}
+
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, reader, offset); err != nil {
+		return "", fmt.Errorf("error reading file '%s': %v", f.path, err)
+	}
+	if accept.Prefix != "" && file != nil && hex.EncodeToString(hash.Sum(nil)) != accept.Prefix {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("error reading file '%s': %v", f.path, err)
+		}
+		hash.Reset()
+		b.mu.Lock()
+		b.sentBytes -= offset
+		b.resumedBytes -= offset
+		b.mu.Unlock()
+		offset, start.Restart = 0, true
+	}
+
+	if len(b.streams) > 0 && f.entry.Size-offset >= parallelThreshold {
+		start.Streams = 1 + len(b.streams)
+	}
+
+	if err := b.conn.Send(protocol.MsgFileStart, start); err != nil {
+		return "", connectionLost{fmt.Errorf("error sending file data: %v", err)}
+	}
+	b.fileBytes = offset
+
+	if start.Streams > 0 {
+		if err := b.sendRanges(index, f, file, offset, start.Compression, hash); err != nil {
+			return "", err
+		}
+		return b.finishEntry(index, hash)
+	}
 
 	for {
 		select {
-		case <-ctx.Done():
-			progressChan <- SendProgress{
-				State: StateCancelled,
-				Error: fmt.Errorf("transfer cancelled"),
+		case <-b.ctx.Done():
+			b.conn.Send(protocol.MsgCancel, protocol.Cancel{})
+			return "", errCancelled
+		case result := <-b.reply:
+			if result.err != nil {
+				return "", connectionLost{fmt.Errorf("receiver stopped the transfer: %v", result.err)}
 			}
-			return
+			return "", fmt.Errorf("receiver stopped the transfer: %v", remoteError(result.frame))
 		default:
 		}
 
-		n, err := file.Read(buffer)
-		if err == io.EOF {
-			break
+		n, err := reader.Read(b.buffer)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("error reading file '%s': %v", f.path, err)
 		}
-		if err != nil {
-			progressChan <- SendProgress{
-				State: StateError,
-				Error: fmt.Errorf("error reading file: %v", err),
+		if n == 0 {
+			if err == io.EOF {
+				break
 			}
-			return
+			continue
 		}
 
-		_, err = conn.Write(buffer[:n])
-		if err != nil {
-			progressChan <- SendProgress{
-				State: StateError,
-				Error: fmt.Errorf("error sending file data: %v", err),
+		hash.Write(b.buffer[:n])
+
+		msgType, payload := protocol.MsgData, b.buffer[:n]
+		if compressor != nil {
+			if b.packed, err = compressor.compress(b.packed[:0], payload); err != nil {
+				return "", fmt.Errorf("error compressing file '%s': %v", f.path, err)
+			}
+			if len(b.packed) < n {
+				msgType, payload = protocol.MsgCompressed, b.packed
 			}
-			return
 		}
 
-		sentBytes += int64(n)
-		speed := float64(sentBytes) / time.Since(startTime).Seconds() / 1024 / 1024
+		if err := throttle(b.ctx, b.limiter, len(payload)); err != nil {
+			b.conn.Send(protocol.MsgCancel, protocol.Cancel{})
+			return "", err
+		}
 
-		progressChan <- SendProgress{
-			State:      StateTransferring,
-			Speed:      speed,
-			BytesSent:  sentBytes,
-			TotalBytes: fileInfo.Size(),
+		b.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		if err := b.conn.WriteFrame(msgType, payload); err != nil {
+			return "", connectionLost{fmt.Errorf("error sending file data: %v", err)}
 		}
+
+		b.advance(index, f.entry, n, len(payload))
 	}
 
-	progressChan <- SendProgress{
-		State:     StateCompleted,
-		BytesSent: sentBytes,
-		Speed:     float64(sentBytes) / time.Since(startTime).Seconds() / 1024 / 1024,
+	return b.finishEntry(index, hash)
+}
+
+func (b *batchSender) finishEntry(index int, hash hash.Hash) (string, error) {
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	done := protocol.FileDone{Index: index}
+	if b.conn.Supports(protocol.CapSHA256) {
+		done.Checksum = checksum
+	}
+
+	if err := b.conn.Send(protocol.MsgFileDone, done); err != nil {
+		return "", connectionLost{fmt.Errorf("error sending file data: %v", err)}
 	}
+	return checksum, nil
 }
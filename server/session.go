@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -22,16 +23,52 @@ func NewSessionManager() *SessionManager {
 	}
 }
 
-func (sm *SessionManager) CreateSession(ctx context.Context) (*TransferSession, error) {
+func (sm *SessionManager) CreateSession(ctx context.Context, addrs []string, port string) (*TransferSession, error) {
+	return sm.Open(ctx, RoleSender, TransferSession{
+		SenderAddrs: addrs,
+		SenderPort:  port,
+	})
+}
+
+// Open creates a session for a peer playing role that listens where
+// endpoint says. Senders open an offer for receivers to join; receivers open
+// a request for a sender to answer.
+func (sm *SessionManager) Open(ctx context.Context, role Role, endpoint TransferSession) (*TransferSession, error) {
+	return sm.createSession(ctx, role, endpoint)
+}
+
+// CreateMultiSession creates a session that up to maxReceivers receivers can
+// join, or any number of them when maxReceivers is zero.
+func (sm *SessionManager) CreateMultiSession(ctx context.Context, addrs []string, port string, maxReceivers int) (*TransferSession, error) {
+	return sm.createSession(ctx, RoleSender, TransferSession{
+		SenderAddrs:  addrs,
+		SenderPort:   port,
+		Multi:        true,
+		MaxReceivers: maxReceivers,
+	})
+}
+
+func (sm *SessionManager) createSession(ctx context.Context, role Role, endpoint TransferSession) (*TransferSession, error) {
+	body, err := json.Marshal(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode session: %v", err)
+	}
+
+	path := "/new"
+	if role == RoleReceiver {
+		path = "/request"
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "POST",
-		RELAY_PROTOCOL+"://"+RELAY_SERVER+"/new", nil)
+		RELAY_PROTOCOL+"://"+RELAY_SERVER+path, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := sm.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create session: %v", err)
+		return nil, fmt.Errorf("failed to create session: %w", ErrRelayServerDown)
 	}
 	defer resp.Body.Close()
 
@@ -49,6 +86,13 @@ func (sm *SessionManager) CreateSession(ctx context.Context) (*TransferSession,
 }
 
 func (sm *SessionManager) JoinSession(ctx context.Context, sessionID string) (*TransferSession, error) {
+	return sm.Join(ctx, RoleReceiver, sessionID)
+}
+
+// Join takes the open side of a session as a peer playing role: receivers
+// join offers and senders answer requests. The returned session carries
+// the endpoint its opener listens on.
+func (sm *SessionManager) Join(ctx context.Context, role Role, sessionID string) (*TransferSession, error) {
 	if sessionID == "" {
 		return nil, SessionError{
 			Code:    "INVALID_SESSION",
@@ -56,8 +100,13 @@ func (sm *SessionManager) JoinSession(ctx context.Context, sessionID string) (*T
 		}
 	}
 
+	path := "/join/"
+	if role == RoleSender {
+		path = "/answer/"
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "GET",
-		RELAY_PROTOCOL+"://"+RELAY_SERVER+"/join/"+sessionID, nil)
+		RELAY_PROTOCOL+"://"+RELAY_SERVER+path+sessionID, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -72,18 +121,28 @@ func (sm *SessionManager) JoinSession(ctx context.Context, sessionID string) (*T
 	case http.StatusNotFound:
 		return nil, ErrSessionNotFound
 	case http.StatusConflict:
+		if role == RoleSender {
+			return nil, ErrRequestAnswered
+		}
 		return nil, ErrSessionConflict
+	case http.StatusGone:
+		return nil, ErrSessionFull
+	case http.StatusUnprocessableEntity:
+		if role == RoleSender {
+			return nil, ErrNotARequest
+		}
+		return nil, ErrRequestCode
 	case http.StatusOK:
 	default:
 		return nil, SessionError{
 			Code:    "UNEXPECTED_ERROR",
-			Message: fmt.Sprintf("Unexpected error (status %d)", resp.StatusCode),
+			Message: fmt.Sprintf("Unexpected error (status %d) - please try again", resp.StatusCode),
 		}
 	}
 
 	var session TransferSession
 	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
-		return nil, fmt.Errorf("invalid session data")
+		return nil, fmt.Errorf("invalid session data - please try again")
 	}
 
 	sm.sessions.Store(session.SessionID, &session)
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxSignalSize  = 64 * 1024
+	signalCapacity = 16
+)
+
+// handleSignal passes WebRTC offers and answers between peers. Each session
+// has mailboxes named by the to parameter: a POST leaves a message in one and
+// a GET waits for the next message in it. A peer that posted an offer waits
+// for the answer in a mailbox of its own, which is dropped once it was read
+// or the peer stopped waiting. The rest go when a peer leaves the session.
+func (s *RelayServer) handleSignal(w http.ResponseWriter, r *http.Request, sessionID string) {
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		http.Error(w, "Invalid signal mailbox", http.StatusBadRequest)
+		return
+	}
+
+	if _, exists := s.sessions.Load(sessionID); !exists {
+		http.Error(w, fmt.Sprintf("Session '%s' not found", sessionID), http.StatusNotFound)
+		return
+	}
+
+	key := sessionID + "/" + to
+
+	switch r.Method {
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignalSize+1))
+		if err != nil || len(body) > maxSignalSize {
+			http.Error(w, "Invalid signal", http.StatusBadRequest)
+			return
+		}
+		if !s.postSignal(key, body) {
+			http.Error(w, "Signal mailbox is full", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		mailbox := s.mailbox(key)
+		if strings.HasPrefix(to, "offer-") {
+			defer s.dropMailbox(key)
+		}
+
+		select {
+		case body := <-mailbox:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		case <-time.After(signalWait):
+			w.WriteHeader(http.StatusNoContent)
+		case <-r.Context().Done():
+		case <-s.stopChan:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *RelayServer) mailbox(key string) chan []byte {
+	s.signalMu.Lock()
+	defer s.signalMu.Unlock()
+	return s.mailboxLocked(key)
+}
+
+func (s *RelayServer) mailboxLocked(key string) chan []byte {
+	mailbox, exists := s.signals[key]
+	if !exists {
+		mailbox = make(chan []byte, signalCapacity)
+		s.signals[key] = mailbox
+	}
+	return mailbox
+}
+
+// postSignal leaves body in the mailbox for key. It holds the lock while it
+// does, so the mailbox cannot be dropped between finding and filling it.
+func (s *RelayServer) postSignal(key string, body []byte) bool {
+	s.signalMu.Lock()
+	defer s.signalMu.Unlock()
+	select {
+	case s.mailboxLocked(key) <- body:
+		return true
+	default:
+		return false
+	}
+}
+
+// dropMailbox forgets the mailbox for key unless a message still waits in it.
+func (s *RelayServer) dropMailbox(key string) {
+	s.signalMu.Lock()
+	defer s.signalMu.Unlock()
+	if mailbox, exists := s.signals[key]; exists && len(mailbox) == 0 {
+		delete(s.signals, key)
+	}
+}
+
+// forgetSignals drops every mailbox of a session.
+func (s *RelayServer) forgetSignals(sessionID string) {
+	s.signalMu.Lock()
+	defer s.signalMu.Unlock()
+	for key := range s.signals {
+		if strings.HasPrefix(key, sessionID+"/") {
+			delete(s.signals, key)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package server
+
+// CheckSpace estimates how many bytes receiving m into dir still needs, counting
+// partial files that can be resumed, and compares it with the free space there.
+// When free space cannot be determined, free is -1 and ok is true.
+func CheckSpace(m FileMetadata, dir string) (needed, free int64, ok bool) {
+	if dir == "" {
+		dir = "."
+	}
+
+	for _, f := range m.Files {
+		if f.Dir {
+			continue
+		}
+		needed += f.Size
+		if name, err := destinationPath(dir, f.Name); err == nil {
+			needed -= resumeOffset(name, f)
+		}
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		return needed, -1, true
+	}
+	return needed, free, needed <= free
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || windows)
+
+package server
+
+import "errors"
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space is not available on this platform")
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"ft_0/protocol"
+	"hash"
+	"io"
+	"time"
+)
+
+type streamReceiver struct {
+	ctx          context.Context
+	limiter      *Limiter
+	conn         *protocol.Conn
+	progressChan chan<- ReceiveProgress
+	out          io.Writer
+	entry        protocol.FileEntry
+	outcome      FileOutcome
+	result       *protocol.FileResult
+	started      bool
+	finished     bool
+	hash         hash.Hash
+	codec        compressor
+	bytes        int64
+	wireBytes    int64
+	startTime    time.Time
+	meter        rateMeter
+}
+
+// ReceiveStream writes the single file offered in m to w in the order it
+// arrives instead of saving it under a destination folder. The sender is told
+// not to split the file across parallel streams, and since w cannot be
+// rewound a failed checksum is only reported after the data was written.
+func ReceiveStream(rc *ReceiverConn, m FileMetadata, w io.Writer, limiter *Limiter, progressChan chan<- ReceiveProgress, ctx context.Context) {
+	conn := rc.Conn
+	go func() {
+		defer close(progressChan)
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		defer conn.SetDeadline(time.Time{})
+
+		progressChan <- ReceiveProgress{State: StateInitializing}
+
+		if len(m.Files) != 1 || m.Files[0].Dir {
+			conn.Send(protocol.MsgReject, protocol.Reject{
+				Code:    ErrTransferRejected.Code,
+				Message: "Receiver can only write a single file to its output",
+			})
+			progressChan <- ReceiveProgress{
+				Error: fmt.Errorf("sender offered %s, only a single file can be written to the output", m.Name),
+				State: StateError,
+			}
+			return
+		}
+
+		r := &streamReceiver{
+			ctx:          ctx,
+			limiter:      limiter,
+			conn:         conn,
+			progressChan: progressChan,
+			out:          w,
+			entry:        m.Files[0],
+			outcome:      FileOutcome{Name: m.Files[0].Name, Size: m.Files[0].Size},
+			hash:         sha256.New(),
+		}
+
+		if err := sendAccept(conn, []protocol.FileAccept{{}}, true); err != nil {
+			progressChan <- ReceiveProgress{
+				Error: fmt.Errorf("failed to accept transfer: %v", err),
+				State: StateError,
+			}
+			return
+		}
+
+		r.startTime = time.Now()
+		r.meter = newRateMeter()
+		progressChan <- ReceiveProgress{
+			TotalBytes: r.entry.Size,
+			State:      StateReceiving,
+		}
+
+		for {
+			done, err := false, errCancelled
+			if ctx.Err() == nil {
+				done, err = r.next()
+			}
+
+			switch {
+			case done:
+				r.finish()
+				return
+			case err == errCancelled:
+				conn.Send(protocol.MsgCancel, protocol.Cancel{})
+				r.cancel(err)
+				return
+			case err == errSenderCancelled:
+				r.cancel(err)
+				return
+			case err != nil:
+				progressChan <- ReceiveProgress{
+					Error: err,
+					State: StateError,
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (r *streamReceiver) next() (bool, error) {
+	r.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	frame, err := r.conn.ReadFrame()
+	if err != nil {
+		return false, fmt.Errorf("failed to read from connection: %v", err)
+	}
+
+	switch frame.Type {
+	case protocol.MsgFileStart:
+		return false, r.start(frame)
+	case protocol.MsgData:
+		return false, r.write(frame.Payload, len(frame.Payload))
+	case protocol.MsgCompressed:
+		if !r.started || r.finished || r.codec == nil {
+			sendError(r.conn, ErrUnexpectedMessage)
+			return false, fmt.Errorf("sender sent compressed data outside of a compressed file")
+		}
+		data, err := r.codec.decompress(frame.Payload)
+		if err != nil {
+			sendError(r.conn, ErrCorruptData)
+			return false, fmt.Errorf("failed to decompress data for '%s': %v", r.entry.Name, err)
+		}
+		return false, r.write(data, len(frame.Payload))
+	case protocol.MsgFileDone:
+		return false, r.finishFile(frame)
+	case protocol.MsgDone:
+		return true, nil
+	case protocol.MsgCancel:
+		return false, errSenderCancelled
+	default:
+		return false, remoteError(frame)
+	}
+}
+
+func (r *streamReceiver) start(frame protocol.Frame) error {
+	var start protocol.FileStart
+	if err := frame.Decode(&start); err != nil {
+		return err
+	}
+	if r.started || start.Index != 0 || start.Streams > 0 {
+		sendError(r.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender started an unexpected file")
+	}
+
+	if start.Compression != "" {
+		if !r.conn.Supports(start.Compression) {
+			sendError(r.conn, ErrUnexpectedMessage)
+			return fmt.Errorf("sender used compression '%s' that was not negotiated", start.Compression)
+		}
+		codec, err := newCompressor(start.Compression)
+		if err != nil {
+			sendError(r.conn, ErrUnexpectedMessage)
+			return err
+		}
+		r.codec = codec
+	}
+
+	r.started = true
+	return nil
+}
+
+func (r *streamReceiver) write(data []byte, wireSize int) error {
+	if !r.started || r.finished {
+		sendError(r.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender sent data outside of a file")
+	}
+	if !r.entry.Stream && r.bytes+int64(len(data)) > r.entry.Size {
+		sendError(r.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender sent more data than announced for '%s'", r.entry.Name)
+	}
+	if err := throttle(r.ctx, r.limiter, wireSize); err != nil {
+		return err
+	}
+
+	r.hash.Write(data)
+	if _, err := r.out.Write(data); err != nil {
+		sendError(r.conn, ErrWriteFailed)
+		return fmt.Errorf("failed to write '%s' to the output: %v", r.entry.Name, err)
+	}
+
+	r.bytes += int64(len(data))
+	r.wireBytes += int64(wireSize)
+	speed, wireSpeed := r.meter.add(len(data), wireSize)
+
+	r.progressChan <- ReceiveProgress{
+		Speed:         speed,
+		WireSpeed:     wireSpeed,
+		BytesReceived: r.bytes,
+		TotalBytes:    r.entry.Size,
+		WireBytes:     r.wireBytes,
+		Streams:       1,
+		FileName:      r.entry.Name,
+		FileBytes:     r.bytes,
+		FileSize:      r.entry.Size,
+		State:         StateReceiving,
+	}
+	return nil
+}
+
+func (r *streamReceiver) finishFile(frame protocol.Frame) error {
+	var done protocol.FileDone
+	if err := frame.Decode(&done); err != nil {
+		return err
+	}
+	if !r.started || r.finished || done.Index != 0 {
+		sendError(r.conn, ErrUnexpectedMessage)
+		return fmt.Errorf("sender finished an unexpected file")
+	}
+	r.finished = true
+
+	checksum := hex.EncodeToString(r.hash.Sum(nil))
+	r.outcome.Checksum = checksum
+	if r.entry.Stream {
+		r.outcome.Size = r.bytes
+	}
+
+	switch {
+	case !r.entry.Stream && r.bytes != r.entry.Size:
+		r.outcome.Error = ErrIncompleteFile
+	case r.conn.Supports(protocol.CapSHA256) && done.Checksum != checksum:
+		r.outcome.Error = ErrChecksumMismatch
+	}
+	if sessionErr, ok := r.outcome.Error.(SessionError); ok {
+		r.result = &protocol.FileResult{Code: sessionErr.Code, Message: sessionErr.Message}
+	}
+	return nil
+}
+
+func (r *streamReceiver) finish() {
+	if !r.finished {
+		r.outcome.Error = ErrIncompleteFile
+		r.result = &protocol.FileResult{Code: ErrIncompleteFile.Code, Message: ErrIncompleteFile.Message}
+	}
+
+	var done protocol.Done
+	if r.result != nil {
+		done.Results = []protocol.FileResult{*r.result}
+	}
+	r.conn.Send(protocol.MsgDone, done)
+
+	state := StateCompleted
+	if r.outcome.Error != nil {
+		state = StateError
+	}
+
+	r.progressChan <- ReceiveProgress{
+		Speed:         r.speed(),
+		WireSpeed:     r.wireSpeed(),
+		BytesReceived: r.bytes,
+		TotalBytes:    r.entry.Size,
+		WireBytes:     r.wireBytes,
+		Files:         []FileOutcome{r.outcome},
+		Error:         r.outcome.Error,
+		State:         state,
+	}
+}
+
+func (r *streamReceiver) cancel(err error) {
+	r.progressChan <- ReceiveProgress{
+		Speed:         r.speed(),
+		BytesReceived: r.bytes,
+		TotalBytes:    r.entry.Size,
+		State:         StateCancelled,
+		Error:         err,
+	}
+}
+
+func (r *streamReceiver) speed() float64 {
+	return float64(r.bytes) / time.Since(r.startTime).Seconds() / 1024 / 1024
+}
+
+func (r *streamReceiver) wireSpeed() float64 {
+	return float64(r.wireBytes) / time.Since(r.startTime).Seconds() / 1024 / 1024
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"ft_0/protocol"
+	"os"
+	"strings"
+)
+
+const (
+	MaxTextSize = 1 << 20
+	textName    = "snippet.txt"
+)
+
+// StartTextSender offers text as a snippet that receivers show inline instead
+// of saving it straight to disk.
+func StartTextSender(text string, limiter *Limiter, progressChan chan<- SendProgress, ctx context.Context) {
+	go func() {
+		defer close(progressChan)
+
+		if strings.TrimSpace(text) == "" {
+			progressChan <- SendProgress{
+				State: StateError,
+				Error: fmt.Errorf("no text to send"),
+			}
+			return
+		}
+		if len(text) > MaxTextSize {
+			progressChan <- SendProgress{
+				State: StateError,
+				Error: fmt.Errorf("text is too long to send as a snippet (%d bytes, at most %d)", len(text), MaxTextSize),
+			}
+			return
+		}
+
+		prepare := func() ([]outgoingFile, error) {
+			return []outgoingFile{{
+				path:   textName,
+				reader: strings.NewReader(text),
+				entry:  protocol.FileEntry{Name: textName, Size: int64(len(text)), Mode: 0o644, Text: true},
+			}}, nil
+		}
+		serveSession(prepare, nil, limiter, progressChan, ctx)
+	}()
+}
+
+// IsText reports whether m is a text snippet small enough to receive in memory.
+func IsText(m FileMetadata) bool {
+	return len(m.Files) == 1 && m.Files[0].Text && m.Files[0].Size <= MaxTextSize
+}
+
+// SaveText writes a received snippet into dir under the name it was offered
+// with, picking a free name instead of overwriting an existing file.
+func SaveText(m FileMetadata, dir string, text []byte) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+	if len(m.Files) != 1 {
+		return "", fmt.Errorf("not a text snippet")
+	}
+
+	name, err := destinationPath(dir, m.Files[0].Name)
+	if err != nil {
+		return "", err
+	}
+	if err := confine(dir, name); err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(name); err == nil {
+		name = availableName(name)
+	}
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file '%s': %v", name, err)
+	}
+	_, err = file.Write(text)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", fmt.Errorf("failed to write to file '%s': %v", name, err)
+	}
+	return name, nil
+}
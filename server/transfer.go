@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"ft_0/protocol"
+)
+
+const (
+	offerBatchSize  = protocol.MaxFrameSize / 2
+	acceptBatchSize = 16 * 1024
+)
+
+var (
+	errCancelled       = errors.New("transfer cancelled")
+	errSenderCancelled = errors.New("transfer cancelled by sender")
+)
+
+type connectionLost struct {
+	err error
+}
+
+func (e connectionLost) Error() string {
+	return e.err.Error()
+}
+
+type frameResult struct {
+	frame protocol.Frame
+	err   error
+}
+
+func readFrameAsync(conn *protocol.Conn) <-chan frameResult {
+	result := make(chan frameResult, 1)
+	go func() {
+		frame, err := conn.ReadFrame()
+		result <- frameResult{frame, err}
+	}()
+	return result
+}
+
+func secureHandshake(conn *protocol.Conn, code string, initiator bool) error {
+	sessionID, _, err := SplitCode(code)
+	if err != nil {
+		return err
+	}
+
+	conn.Streams = STREAMS
+	err = conn.Secure(code, sessionID, initiator)
+	if err == nil {
+		err = conn.Handshake(capabilities)
+	}
+	switch {
+	case errors.Is(err, protocol.ErrAuthFailed):
+		return ErrWrongCode
+	case errors.Is(err, protocol.ErrIncompatibleVersion):
+		return ErrIncompatibleVersion
+	}
+	return err
+}
+
+func remoteError(frame protocol.Frame) error {
+	switch frame.Type {
+	case protocol.MsgError:
+		var e protocol.Error
+		if err := frame.Decode(&e); err != nil {
+			return err
+		}
+		return SessionError{Code: e.Code, Message: e.Message}
+	case protocol.MsgReject:
+		var r protocol.Reject
+		if err := frame.Decode(&r); err != nil {
+			return err
+		}
+		if r.Code == "" || r.Code == ErrTransferRejected.Code {
+			return ErrTransferRejected
+		}
+		return SessionError{Code: r.Code, Message: r.Message}
+	case protocol.MsgCancel:
+		return fmt.Errorf("transfer cancelled by peer")
+	default:
+		return fmt.Errorf("unexpected %s message from peer", frame.Type)
+	}
+}
+
+func sendError(conn *protocol.Conn, err error) {
+	e := protocol.Error{Code: "UNEXPECTED_ERROR", Message: err.Error()}
+	if sessionErr, ok := err.(SessionError); ok {
+		e = protocol.Error{Code: sessionErr.Code, Message: sessionErr.Message}
+	}
+	conn.Send(protocol.MsgError, e)
+}
+
+func sendOffer(conn *protocol.Conn, files []protocol.FileEntry) error {
+	var batch []protocol.FileEntry
+	size := 0
+	for i, f := range files {
+		batch = append(batch, f)
+		size += len(f.Name) + 128
+		if size >= offerBatchSize && i < len(files)-1 {
+			if err := conn.Send(protocol.MsgOffer, protocol.Offer{Files: batch, More: true}); err != nil {
+				return err
+			}
+			batch, size = nil, 0
+		}
+	}
+	return conn.Send(protocol.MsgOffer, protocol.Offer{Files: batch})
+}
+
+func readOffer(conn *protocol.Conn, frame protocol.Frame) (protocol.Offer, error) {
+	var offer protocol.Offer
+	for {
+		if frame.Type != protocol.MsgOffer {
+			return protocol.Offer{}, remoteError(frame)
+		}
+
+		var batch protocol.Offer
+		if err := frame.Decode(&batch); err != nil {
+			return protocol.Offer{}, err
+		}
+		offer.Files = append(offer.Files, batch.Files...)
+		if !batch.More {
+			return offer, nil
+		}
+
+		var err error
+		if frame, err = conn.ReadFrame(); err != nil {
+			return protocol.Offer{}, err
+		}
+	}
+}
+
+func sendAccept(conn *protocol.Conn, files []protocol.FileAccept, sequential bool) error {
+	for len(files) > acceptBatchSize {
+		if err := conn.Send(protocol.MsgAccept, protocol.Accept{Files: files[:acceptBatchSize], More: true}); err != nil {
+			return err
+		}
+		files = files[acceptBatchSize:]
+	}
+	return conn.Send(protocol.MsgAccept, protocol.Accept{Files: files, Sequential: sequential})
+}
+
+func readAccept(conn *protocol.Conn, frame protocol.Frame) (protocol.Accept, error) {
+	var accept protocol.Accept
+	for {
+		if frame.Type != protocol.MsgAccept {
+			return protocol.Accept{}, remoteError(frame)
+		}
+
+		var batch protocol.Accept
+		if err := frame.Decode(&batch); err != nil {
+			return protocol.Accept{}, err
+		}
+		accept.Files = append(accept.Files, batch.Files...)
+		if !batch.More {
+			accept.Sequential = batch.Sequential
+			return accept, nil
+		}
+
+		var err error
+		if frame, err = conn.ReadFrame(); err != nil {
+			return protocol.Accept{}, err
+		}
+	}
+}
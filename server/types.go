@@ -1,19 +1,81 @@
 package server
 
-import "fmt"
+import (
+	"fmt"
+	"ft_0/protocol"
+	"time"
+)
 
+// TransferSession is the relay's record of a session. SenderAddrs,
+// SenderPort and QUICPort publish where the side that opened it listens,
+// which is the receiver for request sessions, WebRTC that it answers offers
+// signalled through the relay and Punch that it punches holes to peers that
+// register with the relay's rendezvous.
 type TransferSession struct {
-	SessionID  string `json:"session_id"`
-	SenderID   string `json:"sender_id"`
-	ReceiverID string `json:"receiver_id"`
+	SessionID    string   `json:"session_id"`
+	SenderID     string   `json:"sender_id"`
+	ReceiverID   string   `json:"receiver_id"`
+	SenderAddrs  []string `json:"sender_addrs,omitempty"`
+	SenderPort   string   `json:"sender_port,omitempty"`
+	QUICPort     string   `json:"quic_port,omitempty"`
+	WebRTC       bool     `json:"webrtc,omitempty"`
+	Punch        bool     `json:"punch,omitempty"`
+	Multi        bool     `json:"multi,omitempty"`
+	MaxReceivers int      `json:"max_receivers,omitempty"`
+	Receivers    []string `json:"receivers,omitempty"`
+	Request      bool     `json:"request,omitempty"`
+}
+
+// Role is the part a peer plays in a transfer, whichever side opened the
+// session. It also names that peer's end of a relay pipe.
+type Role string
+
+const (
+	RoleSender   Role = "sender"
+	RoleReceiver Role = "receiver"
+)
+
+// MultiOptions opens a session that several receivers can join, each served
+// on its own connection. Zero means no limit.
+type MultiOptions struct {
+	MaxReceivers int
+	Timeout      time.Duration
 }
 
 type FileMetadata struct {
 	Name     string
 	Size     int64
+	Files    []protocol.FileEntry
 	SenderIP string
 }
 
+type FileOutcome struct {
+	Name     string
+	Size     int64
+	Checksum string
+	Skipped  bool
+	Error    error
+}
+
+type ConflictPolicy string
+
+const (
+	ConflictRename    ConflictPolicy = "rename"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictResume    ConflictPolicy = "resume"
+	ConflictAsk       ConflictPolicy = "ask"
+)
+
+var ConflictPolicies = []ConflictPolicy{ConflictRename, ConflictOverwrite, ConflictSkip, ConflictResume, ConflictAsk}
+
+// Conflicts decides what happens to files whose destination already exists.
+// Files holds per-file answers by offer index; the rest follow Policy.
+type Conflicts struct {
+	Policy ConflictPolicy
+	Files  map[int]ConflictPolicy
+}
+
 type TransferState int
 
 const (
@@ -44,6 +106,22 @@ var (
 		Code:    "SESSION_CONFLICT",
 		Message: "Session already has a receiver",
 	}
+	ErrSessionFull = SessionError{
+		Code:    "SESSION_FULL",
+		Message: "Session is not accepting more receivers",
+	}
+	ErrNotARequest = SessionError{
+		Code:    "NOT_A_REQUEST",
+		Message: "This code is not a file request - use it to receive instead",
+	}
+	ErrRequestCode = SessionError{
+		Code:    "REQUEST_CODE",
+		Message: "This code asks for a file - use it to send instead",
+	}
+	ErrRequestAnswered = SessionError{
+		Code:    "REQUEST_ANSWERED",
+		Message: "Another sender is already answering this request",
+	}
 	ErrConnectionTimeout = SessionError{
 		Code:    "CONNECTION_TIMEOUT",
 		Message: "Connection timed out - please try again",
@@ -56,4 +134,48 @@ var (
 		Code:    "RELAY_SERVER_DOWN",
 		Message: "Could not connect to relay server - is it running?",
 	}
+	ErrInvalidCode = SessionError{
+		Code:    "INVALID_CODE",
+		Message: "Please enter the full code shared by the sender",
+	}
+	ErrWrongCode = SessionError{
+		Code:    "WRONG_CODE",
+		Message: "Could not verify the code - check it and try again",
+	}
+	ErrIncompatibleVersion = SessionError{
+		Code:    "INCOMPATIBLE_VERSION",
+		Message: "The other side runs an incompatible version of FT_0 - update both sides",
+	}
+	ErrTooManyAttempts = SessionError{
+		Code:    "TOO_MANY_ATTEMPTS",
+		Message: "Session closed after too many receivers failed to verify the code",
+	}
+	ErrChecksumMismatch = SessionError{
+		Code:    "CHECKSUM_MISMATCH",
+		Message: "Received file does not match the sender's checksum",
+	}
+	ErrWriteFailed = SessionError{
+		Code:    "WRITE_FAILED",
+		Message: "Receiver could not write the file",
+	}
+	ErrIncompleteFile = SessionError{
+		Code:    "INCOMPLETE_FILE",
+		Message: "File ended before all of its data arrived",
+	}
+	ErrCorruptData = SessionError{
+		Code:    "CORRUPT_DATA",
+		Message: "Received data could not be decompressed",
+	}
+	ErrUnexpectedMessage = SessionError{
+		Code:    "UNEXPECTED_MESSAGE",
+		Message: "Peer sent a message out of order",
+	}
+	ErrUnsafePath = SessionError{
+		Code:    "UNSAFE_PATH",
+		Message: "Receiver refused a file name that points outside its destination folder",
+	}
+	ErrInsufficientSpace = SessionError{
+		Code:    "INSUFFICIENT_SPACE",
+		Message: "Receiver does not have enough free disk space for the transfer",
+	}
 )
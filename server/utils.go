@@ -3,10 +3,71 @@ package server
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"net"
+	"strings"
 )
 
+// longSecretBytes sizes the secret of codes that stay valid for several
+// receivers, which gives guessers more attempts than a one-off code.
+const longSecretBytes = 6
+
 func GenerateID() string {
-	bytes := make([]byte, 3)
+	return randomHex(3)
+}
+
+func GenerateCode(sessionID string) string {
+	return sessionID + "-" + GenerateID()
+}
+
+func generateLongCode(sessionID string) string {
+	return sessionID + "-" + randomHex(longSecretBytes)
+}
+
+func randomHex(n int) string {
+	bytes := make([]byte, n)
 	rand.Read(bytes)
 	return hex.EncodeToString(bytes)
 }
+
+func SplitCode(code string) (sessionID, secret string, err error) {
+	sessionID, secret, found := strings.Cut(strings.TrimSpace(code), "-")
+	if !found || sessionID == "" || secret == "" {
+		return "", "", ErrInvalidCode
+	}
+	return sessionID, secret, nil
+}
+
+func LocalAddresses() []string {
+	var addrs, loopback []string
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifaceAddrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsMulticast() {
+				continue
+			}
+			if ipNet.IP.IsLoopback() {
+				loopback = append(loopback, ipNet.IP.String())
+				continue
+			}
+			addrs = append(addrs, ipNet.IP.String())
+		}
+	}
+
+	if len(addrs) == 0 {
+		return loopback
+	}
+	return addrs
+}
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Data channels carry messages rather than a byte stream, so writes are
+	// split into messages of this size and reads buffer what is left over.
+	webrtcMessageSize = 16 * 1024
+	webrtcMaxBuffered = 1024 * 1024
+	webrtcTimeout     = 5 * time.Second
+	webrtcLinger      = 2 * time.Second
+	signalWait        = 20 * time.Second
+)
+
+var signalClient = &http.Client{Timeout: signalWait + 10*time.Second}
+
+// signal is an SDP offer or answer passed through the relay's mailboxes.
+// Offers name the mailbox the answer should be left in.
+type signal struct {
+	From        string                    `json:"from,omitempty"`
+	Description webrtc.SessionDescription `json:"description"`
+}
+
+func webrtcAPI(loopback bool) *webrtc.API {
+	var settings webrtc.SettingEngine
+	settings.DetachDataChannels()
+	settings.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	if loopback {
+		settings.SetIncludeLoopbackCandidate(true)
+		settings.SetIPFilter(func(ip net.IP) bool { return ip.IsLoopback() })
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+}
+
+func newPeerConnection(settings peerSettings) (*webrtcPeer, error) {
+	config := webrtc.Configuration{}
+	if len(settings.iceServers) > 0 {
+		config.ICEServers = []webrtc.ICEServer{{URLs: settings.iceServers}}
+	}
+
+	pc, err := webrtcAPI(settings.loopback).NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &webrtcPeer{pc: pc, incoming: make(chan *webrtcConn, settings.streams)}
+	pc.OnDataChannel(func(channel *webrtc.DataChannel) {
+		p.open(channel, func(conn *webrtcConn) {
+			select {
+			case p.incoming <- conn:
+			default:
+				conn.Close()
+			}
+		})
+	})
+	return p, nil
+}
+
+// webrtcPeer is one peer connection, whose data channels are the transfer's
+// connections. The first channel owns it: closing that one closes the peer
+// connection.
+type webrtcPeer struct {
+	pc       *webrtc.PeerConnection
+	incoming chan *webrtcConn
+	primary  sync.Once
+}
+
+// open detaches channel once it opens and hands it to opened.
+func (p *webrtcPeer) open(channel *webrtc.DataChannel, opened func(*webrtcConn)) {
+	channel.SetBufferedAmountLowThreshold(webrtcMaxBuffered / 2)
+	channel.OnOpen(func() {
+		rw, err := channel.DetachWithDeadline()
+		if err != nil {
+			channel.Close()
+			return
+		}
+
+		conn := &webrtcConn{
+			peer:    p,
+			channel: channel,
+			rw:      rw,
+			message: make([]byte, 64*1024),
+			drained: make(chan struct{}, 1),
+		}
+		p.primary.Do(func() { conn.owner = true })
+		channel.OnBufferedAmountLow(func() {
+			select {
+			case conn.drained <- struct{}{}:
+			default:
+			}
+		})
+		opened(conn)
+	})
+}
+
+// createChannel opens a data channel from this side and returns a channel
+// that delivers it once the peer accepted it.
+func (p *webrtcPeer) createChannel() (<-chan *webrtcConn, error) {
+	channel, err := p.pc.CreateDataChannel("ft0", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	opened := make(chan *webrtcConn, 1)
+	p.open(channel, func(conn *webrtcConn) { opened <- conn })
+	return opened, nil
+}
+
+func (p *webrtcPeer) acceptChannel(ctx context.Context) (*webrtcConn, error) {
+	select {
+	case conn := <-p.incoming:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *webrtcPeer) addrs() (net.Addr, net.Addr) {
+	local, remote := &net.UDPAddr{}, &net.UDPAddr{}
+	if sctp := p.pc.SCTP(); sctp != nil {
+		if pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+			local = &net.UDPAddr{IP: net.ParseIP(pair.Local.Address), Port: int(pair.Local.Port)}
+			remote = &net.UDPAddr{IP: net.ParseIP(pair.Remote.Address), Port: int(pair.Remote.Port)}
+		}
+	}
+	return local, remote
+}
+
+// describe sets desc as this side's description and waits for ICE gathering,
+// so the description sent to the peer lists every candidate.
+func (p *webrtcPeer) describe(ctx context.Context, desc webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	gathered := webrtc.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(desc); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	select {
+	case <-gathered:
+		return *p.pc.LocalDescription(), nil
+	case <-ctx.Done():
+		return webrtc.SessionDescription{}, ctx.Err()
+	}
+}
+
+// webrtcConn is a detached data channel used as a net.Conn.
+type webrtcConn struct {
+	peer    *webrtcPeer
+	channel *webrtc.DataChannel
+	rw      datachannel.ReadWriteCloserDeadliner
+	message []byte
+	unread  []byte
+	drained chan struct{}
+	owner   bool
+}
+
+func (c *webrtcConn) Read(p []byte) (int, error) {
+	if len(c.unread) == 0 {
+		n, err := c.rw.Read(c.message)
+		if err != nil {
+			return 0, err
+		}
+		c.unread = c.message[:n]
+	}
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *webrtcConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		for c.channel.BufferedAmount() > webrtcMaxBuffered {
+			select {
+			case <-c.drained:
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		n, err := c.rw.Write(p[:min(len(p), webrtcMessageSize)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close gives the peer a moment to acknowledge what was written before the
+// channel is closed, since closing it or the peer connection drops anything
+// still queued.
+func (c *webrtcConn) Close() error {
+	c.rw.SetReadDeadline(time.Now())
+	go func() {
+		deadline := time.Now().Add(webrtcLinger)
+		for c.channel.BufferedAmount() > 0 && c.channel.ReadyState() == webrtc.DataChannelStateOpen && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		c.rw.Close()
+		if c.owner {
+			c.peer.pc.Close()
+		}
+	}()
+	return nil
+}
+
+func (c *webrtcConn) LocalAddr() net.Addr {
+	local, _ := c.peer.addrs()
+	return local
+}
+
+func (c *webrtcConn) RemoteAddr() net.Addr {
+	_, remote := c.peer.addrs()
+	return remote
+}
+
+func (c *webrtcConn) SetDeadline(t time.Time) error {
+	if err := c.rw.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rw.SetWriteDeadline(t)
+}
+
+func (c *webrtcConn) SetReadDeadline(t time.Time) error {
+	return c.rw.SetReadDeadline(t)
+}
+
+func (c *webrtcConn) SetWriteDeadline(t time.Time) error {
+	return c.rw.SetWriteDeadline(t)
+}
+
+// openStream opens another data channel to the peer, used by the receiver
+// for parallel transfer streams.
+func (c *webrtcConn) openStream(ctx context.Context) (net.Conn, error) {
+	opened, err := c.peer.createChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case conn := <-opened:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acceptStream waits for a data channel the peer opened with openStream.
+func (c *webrtcConn) acceptStream(ctx context.Context) (net.Conn, error) {
+	return c.peer.acceptChannel(ctx)
+}
+
+// dialWebRTC offers a peer connection to the peer listening for offers in
+// the session's mailbox named to and returns its first data channel.
+func dialWebRTC(settings peerSettings, sessionID, to string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webrtcTimeout)
+	defer cancel()
+
+	p, err := newPeerConnection(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := func() (*webrtcConn, error) {
+		opened, err := p.createChannel()
+		if err != nil {
+			return nil, err
+		}
+
+		offer, err := p.pc.CreateOffer(nil)
+		if err != nil {
+			return nil, err
+		}
+		if offer, err = p.describe(ctx, offer); err != nil {
+			return nil, err
+		}
+
+		from := "offer-" + GenerateID()
+		if err := postSignal(ctx, settings, sessionID, to, signal{From: from, Description: offer}); err != nil {
+			return nil, err
+		}
+		answer, err := pollSignal(ctx, settings, sessionID, from)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.pc.SetRemoteDescription(answer.Description); err != nil {
+			return nil, err
+		}
+
+		select {
+		case conn := <-opened:
+			return conn, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}()
+	if err != nil {
+		p.pc.Close()
+		return nil, fmt.Errorf("WebRTC connection failed: %v", err)
+	}
+	return conn, nil
+}
+
+// answerWebRTC answers offers left in the session's mailbox named to until
+// ctx ends, handing each peer's first data channel to accepted.
+func answerWebRTC(ctx context.Context, settings peerSettings, sessionID, to string, accepted func(net.Conn)) {
+	for {
+		offer, err := pollSignal(ctx, settings, sessionID, to)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		go func() {
+			conn, err := answerOffer(ctx, settings, sessionID, offer)
+			if err != nil {
+				return
+			}
+			accepted(conn)
+		}()
+	}
+}
+
+func answerOffer(ctx context.Context, settings peerSettings, sessionID string, offer signal) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, webrtcTimeout)
+	defer cancel()
+
+	p, err := newPeerConnection(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := func() (*webrtcConn, error) {
+		if err := p.pc.SetRemoteDescription(offer.Description); err != nil {
+			return nil, err
+		}
+		answer, err := p.pc.CreateAnswer(nil)
+		if err != nil {
+			return nil, err
+		}
+		if answer, err = p.describe(ctx, answer); err != nil {
+			return nil, err
+		}
+		if err := postSignal(ctx, settings, sessionID, offer.From, signal{Description: answer}); err != nil {
+			return nil, err
+		}
+		return p.acceptChannel(ctx)
+	}()
+	if err != nil {
+		p.pc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func signalURL(settings peerSettings, sessionID, to string) string {
+	return settings.relayURL + "/signal/" + sessionID + "?to=" + to
+}
+
+func postSignal(ctx context.Context, settings peerSettings, sessionID, to string, s signal) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", signalURL(settings, sessionID, to), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := signalClient.Do(req)
+	if err != nil {
+		return ErrRelayServerDown
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("relay refused signal (status %d)", resp.StatusCode)
+	}
+	return nil
+}
+
+// pollSignal waits for a message in the session's mailbox named to.
+func pollSignal(ctx context.Context, settings peerSettings, sessionID, to string) (signal, error) {
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", signalURL(settings, sessionID, to), nil)
+		if err != nil {
+			return signal{}, err
+		}
+
+		resp, err := signalClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return signal{}, ctx.Err()
+			}
+			return signal{}, ErrRelayServerDown
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var s signal
+			err := json.NewDecoder(resp.Body).Decode(&s)
+			resp.Body.Close()
+			return s, err
+		case http.StatusNoContent:
+			resp.Body.Close()
+		default:
+			resp.Body.Close()
+			return signal{}, fmt.Errorf("relay refused signal (status %d)", resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package test
+
+import (
+	"ft_0/server"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("AppData", t.TempDir())
+
+	if config := server.LoadConfig(); config != (server.Config{}) {
+		t.Fatalf("expected an empty config, got %+v", config)
+	}
+
+	dir := t.TempDir()
+	if err := server.SaveConfig(server.Config{DownloadDir: dir}); err != nil {
+		t.Fatalf("failed to save config: %v", err)
+	}
+	if config := server.LoadConfig(); config.DownloadDir != dir {
+		t.Errorf("expected download dir %q, got %q", dir, config.DownloadDir)
+	}
+}
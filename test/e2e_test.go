@@ -0,0 +1,2435 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"ft_0/protocol"
+	"ft_0/server"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func useRelay(t *testing.T, mock *MockRelayServer) {
+	originalServer := server.RELAY_SERVER
+	originalProtocol := server.RELAY_PROTOCOL
+	server.RELAY_SERVER = mock.URL()[7:]
+	server.RELAY_PROTOCOL = "http"
+	useDiscovery(t, false)
+	t.Cleanup(func() {
+		server.RELAY_SERVER = originalServer
+		server.RELAY_PROTOCOL = originalProtocol
+	})
+}
+
+func useWorkDir(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func useStreams(t *testing.T, streams int) {
+	original := server.STREAMS
+	server.STREAMS = streams
+	t.Cleanup(func() { server.STREAMS = original })
+}
+
+func writeTempFile(t *testing.T, name string, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func waitForSession(t *testing.T, progressChan <-chan server.SendProgress) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p, ok := <-progressChan:
+			if !ok {
+				t.Fatal("sender stopped before creating a session")
+			}
+			if p.Error != nil {
+				t.Fatalf("sender error: %v", p.Error)
+			}
+			if p.State == server.StateWaitingForReceiver {
+				return p.Code
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for session")
+		}
+	}
+}
+
+func drainSender(progressChan <-chan server.SendProgress) <-chan server.SendProgress {
+	last := make(chan server.SendProgress, 1)
+	go func() {
+		var final server.SendProgress
+		for p := range progressChan {
+			final = p
+		}
+		last <- final
+	}()
+	return last
+}
+
+func drainReceiver(t *testing.T, progressChan <-chan server.ReceiveProgress) server.ReceiveProgress {
+	var final server.ReceiveProgress
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case p, ok := <-progressChan:
+			if !ok {
+				return final
+			}
+			final = p
+		case <-timeout:
+			t.Fatal("timed out waiting for receiver")
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := useWorkDir(t)
+
+	path, data := writeTempFile(t, "payload.bin", 256*1024+17)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if meta.Name != "payload.bin" || meta.Size != int64(len(data)) {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "payload.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received file does not match the sent file")
+	}
+
+	digest := sha256.Sum256(data)
+	if len(final.Files) != 1 || final.Files[0].Checksum != hex.EncodeToString(digest[:]) {
+		t.Errorf("unexpected file outcomes %+v", final.Files)
+	}
+}
+
+func TestTransferConcurrentSenders(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Both senders listen at once, so neither may hold a port the other wants.
+	var conns []*server.ReceiverConn
+	var sent [][]byte
+	var senders []<-chan server.SendProgress
+	for i := range 2 {
+		path, data := writeTempFile(t, fmt.Sprintf("payload%d.bin", i), 64*1024)
+		sendChan := make(chan server.SendProgress)
+		server.StartSender([]string{path}, nil, sendChan, ctx)
+		code := waitForSession(t, sendChan)
+		senders = append(senders, drainSender(sendChan))
+
+		conn, err := server.StartReceiver(code)
+		if err != nil {
+			t.Fatalf("failed to join session %d: %v", i, err)
+		}
+		conns = append(conns, conn)
+		sent = append(sent, data)
+	}
+
+	for i, conn := range conns {
+		meta, err := server.ReceiveMetadata(conn)
+		if err != nil {
+			t.Fatalf("failed to receive metadata: %v", err)
+		}
+
+		dir := t.TempDir()
+		recvChan := make(chan server.ReceiveProgress)
+		server.ReceiveFile(conn, meta, dir, server.Conflicts{}, nil, recvChan, ctx)
+		if final := drainReceiver(t, recvChan); final.State != server.StateCompleted {
+			t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+		}
+		if done := <-senders[i]; done.State != server.StateCompleted {
+			t.Fatalf("sender did not complete, got state %d (%v)", done.State, done.Error)
+		}
+
+		received, err := os.ReadFile(filepath.Join(dir, meta.Name))
+		if err != nil || !bytes.Equal(received, sent[i]) {
+			t.Errorf("received file %d does not match the sent file (%v)", i, err)
+		}
+	}
+}
+
+func TestTransferPortRange(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	port := freePort(t)
+	original := server.TRANSFER_PORT
+	server.TRANSFER_PORT = port + "-" + port
+	t.Cleanup(func() { server.TRANSFER_PORT = original })
+
+	path, _ := writeTempFile(t, "payload.bin", 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, first, ctx)
+	waitForSession(t, first)
+	go drainSender(first)
+
+	second := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, second, ctx)
+	final := <-drainSender(second)
+	if final.Error == nil || !strings.Contains(final.Error.Error(), "no free port in "+server.TRANSFER_PORT) {
+		t.Fatalf("expected the range to be exhausted, got state %d (%v)", final.State, final.Error)
+	}
+}
+
+func TestTransferPortInvalid(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	path, _ := writeTempFile(t, "payload.bin", 1024)
+
+	tests := []struct {
+		ports string
+		want  string
+	}{
+		{"70000", "invalid transfer port"},
+		{"http", "invalid transfer port"},
+		{"0-10", "invalid port range"},
+		{"3001-70000", "invalid port range"},
+		{"3010-3001", "invalid port range"},
+		{"-3001", "invalid port range"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ports, func(t *testing.T) {
+			original := server.TRANSFER_PORT
+			server.TRANSFER_PORT = tt.ports
+			t.Cleanup(func() { server.TRANSFER_PORT = original })
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			progress := make(chan server.SendProgress)
+			server.StartSender([]string{path}, nil, progress, ctx)
+			final := <-drainSender(progress)
+			if final.State != server.StateError || final.Error == nil || !strings.Contains(final.Error.Error(), tt.want) {
+				t.Fatalf("expected %q for %q, got state %d (%v)", tt.want, tt.ports, final.State, final.Error)
+			}
+		})
+	}
+}
+
+func TestTransferDestination(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := useWorkDir(t)
+	dest := t.TempDir()
+
+	path, data := writeTempFile(t, "payload.bin", 64*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, dest, server.Conflicts{}, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dest, "payload.bin"))
+	if err != nil {
+		t.Fatalf("received file missing from destination: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received file does not match the sent file")
+	}
+	if final.Files[0].Name != filepath.Join(dest, "payload.bin") {
+		t.Errorf("unexpected outcome name %q", final.Files[0].Name)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Error("files were written to the working directory")
+	}
+}
+
+func TestTransferConflicts(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := useWorkDir(t)
+
+	names := []string{"rename.txt", "overwrite.txt", "skip.txt", "resume.bin", "mismatch.bin", "new.txt", "diverged.bin", "archive.tar.gz"}
+	var paths []string
+	sent := make(map[string][]byte)
+	for _, name := range names {
+		path, data := writeTempFile(t, name, 96*1024)
+		paths = append(paths, path)
+		sent[name] = data
+	}
+
+	existing := map[string][]byte{
+		"rename.txt":    []byte("keep me"),
+		"overwrite.txt": []byte("replace me"),
+		"skip.txt":      []byte("leave me alone"),
+		"resume.bin":    sent["resume.bin"][:80*1024],
+		"mismatch.bin":  []byte("not a prefix of the incoming file"),
+		// Same first 64KB as the incoming file, different after that.
+		"diverged.bin":   append(slices.Clone(sent["diverged.bin"][:64*1024]), make([]byte, 16*1024)...),
+		"archive.tar.gz": []byte("an older archive"),
+	}
+	for name, data := range existing {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender(paths, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if conflicts := server.FindConflicts(meta, "."); len(conflicts) != len(existing) {
+		t.Fatalf("expected %d conflicts, got %v", len(existing), conflicts)
+	}
+
+	conflicts := server.Conflicts{
+		Policy: server.ConflictResume,
+		Files: map[int]server.ConflictPolicy{
+			0: server.ConflictRename,
+			1: server.ConflictOverwrite,
+			2: server.ConflictSkip,
+			7: server.ConflictRename,
+		},
+	}
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", conflicts, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if !final.Files[2].Skipped || final.Files[0].Skipped {
+		t.Errorf("unexpected skipped outcomes %+v", final.Files)
+	}
+	if result := <-senderDone; result.State != server.StateCompleted || !result.Files[2].Skipped {
+		t.Fatalf("sender did not complete with a skipped file, got state %d (%v)", result.State, result.Error)
+	}
+
+	expected := map[string][]byte{
+		"rename.txt":         existing["rename.txt"],
+		"rename (1).txt":     sent["rename.txt"],
+		"overwrite.txt":      sent["overwrite.txt"],
+		"skip.txt":           existing["skip.txt"],
+		"resume.bin":         sent["resume.bin"],
+		"mismatch.bin":       existing["mismatch.bin"],
+		"mismatch (1).bin":   sent["mismatch.bin"],
+		"new.txt":            sent["new.txt"],
+		"diverged.bin":       existing["diverged.bin"],
+		"diverged (1).bin":   sent["diverged.bin"],
+		"archive.tar.gz":     existing["archive.tar.gz"],
+		"archive (1).tar.gz": sent["archive.tar.gz"],
+	}
+	for name, data := range expected {
+		received, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s missing: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(received, data) {
+			t.Errorf("%s has unexpected contents", name)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != len(expected) {
+		t.Errorf("expected %d files, found %d", len(expected), len(entries))
+	}
+}
+
+func TestTransferBatch(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := useWorkDir(t)
+
+	names := []string{"first.bin", "empty.bin", "third.bin"}
+	sizes := []int{300*1024 + 5, 0, 4096}
+	paths := make([]string, len(names))
+	contents := make([][]byte, len(names))
+	for i, name := range names {
+		paths[i], contents[i] = writeTempFile(t, name, sizes[i])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender(paths, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if len(meta.Files) != len(names) || meta.Size != int64(sizes[0]+sizes[1]+sizes[2]) {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+
+	sent := <-senderDone
+	if sent.State != server.StateCompleted || len(sent.Files) != len(names) {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	for i, name := range names {
+		received, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("received file %s missing: %v", name, err)
+		}
+		if !bytes.Equal(received, contents[i]) {
+			t.Errorf("received file %s does not match the sent file", name)
+		}
+
+		sum := sha256.Sum256(contents[i])
+		digest := hex.EncodeToString(sum[:])
+		if final.Files[i].Checksum != digest || sent.Files[i].Checksum != digest {
+			t.Errorf("unexpected checksum for %s: got %q and %q", name, final.Files[i].Checksum, sent.Files[i].Checksum)
+		}
+		if final.Files[i].Error != nil || sent.Files[i].Error != nil {
+			t.Errorf("unexpected error for %s: %v / %v", name, final.Files[i].Error, sent.Files[i].Error)
+		}
+	}
+}
+
+func TestTransferDirectory(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	root := filepath.Join(t.TempDir(), "project")
+	files := map[string]os.FileMode{
+		"README.md":          0o644,
+		"bin/run.sh":         0o755,
+		"src/deep/nested.go": 0o600,
+	}
+	contents := make(map[string][]byte)
+	for name, mode := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		contents[name] = make([]byte, 20*1024+len(name))
+		rand.Read(contents[name])
+		if err := os.WriteFile(path, contents[name], mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(path, mode)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "empty", "inner"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	many := filepath.Join(root, "many")
+	if err := os.Mkdir(many, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2500 {
+		name := fmt.Sprintf("%03d-%s", i, strings.Repeat("x", 200))
+		if err := os.WriteFile(filepath.Join(many, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := useWorkDir(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{root}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if meta.Name != "project/" {
+		t.Errorf("unexpected metadata name %q", meta.Name)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	for name, mode := range files {
+		path := filepath.Join(dir, "project", filepath.FromSlash(name))
+		received, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("received file %s missing: %v", name, err)
+		}
+		if !bytes.Equal(received, contents[name]) {
+			t.Errorf("received file %s does not match the sent file", name)
+		}
+		if info, err := os.Stat(path); runtime.GOOS != "windows" && (err != nil || info.Mode().Perm() != mode) {
+			t.Errorf("unexpected mode for %s: got %v, want %v", name, info.Mode().Perm(), mode)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "project", "empty", "inner"))
+	if err != nil || !info.IsDir() {
+		t.Fatalf("empty directory was not recreated: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o750 {
+		t.Errorf("unexpected directory mode %v", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "project", "many"))
+	if err != nil || len(entries) != 2500 {
+		t.Errorf("expected 2500 files in a large directory, got %d (%v)", len(entries), err)
+	}
+}
+
+func TestTransferSymlinkedRoot(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	target := t.TempDir()
+	path, data := writeTempFile(t, "target.bin", 4096)
+	if err := os.WriteFile(filepath.Join(target, "inside.txt"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := t.TempDir()
+	fileLink, dirLink := filepath.Join(links, "file-link.bin"), filepath.Join(links, "dir-link")
+	if err := os.Symlink(path, fileLink); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if err := os.Symlink(target, dirLink); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := useWorkDir(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{fileLink, dirLink}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	if final := drainReceiver(t, recvChan); final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	for _, name := range []string{"file-link.bin", filepath.Join("dir-link", "inside.txt")} {
+		received, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(received, data) {
+			t.Errorf("received %s does not match the linked file (%v)", name, err)
+		}
+	}
+}
+
+func TestTransferRejected(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	path, _ := writeTempFile(t, "rejected.bin", 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	if _, err := server.ReceiveMetadata(conn); err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if err := server.RejectTransfer(conn); err != nil {
+		t.Fatalf("failed to reject transfer: %v", err)
+	}
+
+	sent := <-senderDone
+	if sent.State != server.StateCancelled || sent.Error != server.ErrTransferRejected {
+		t.Fatalf("expected rejection, got state %d (%v)", sent.State, sent.Error)
+	}
+}
+
+func TestTransferWrongCode(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	path, _ := writeTempFile(t, "secret.bin", 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	sessionID, _, err := server.SplitCode(code)
+	if err != nil {
+		t.Fatalf("invalid code %q: %v", code, err)
+	}
+
+	if _, err := server.StartReceiver(sessionID + "-000000"); err != server.ErrWrongCode {
+		t.Fatalf("expected ErrWrongCode for receiver, got %v", err)
+	}
+	if sent := <-senderDone; sent.Error != server.ErrWrongCode {
+		t.Fatalf("expected ErrWrongCode for sender, got %v", sent.Error)
+	}
+}
+
+type fakeSender struct {
+	code string
+	conn chan *protocol.Conn
+	err  chan error
+}
+
+func startFakeSender(t *testing.T, capabilities ...string) *fakeSender {
+	if len(capabilities) == 0 {
+		capabilities = []string{protocol.CapSHA256}
+	}
+	startRelay(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	session, err := server.NewSessionManager().CreateSession(ctx, nil, freePort(t))
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	f := &fakeSender{
+		code: server.GenerateCode(session.SessionID),
+		conn: make(chan *protocol.Conn, 1),
+		err:  make(chan error, 1),
+	}
+
+	go func() {
+		raw, err := server.DialRelayPipe(ctx, session.SessionID, "sender")
+		if err != nil {
+			f.err <- err
+			return
+		}
+		conn := protocol.NewConn(raw)
+		if err := conn.Secure(f.code, session.SessionID, false); err != nil {
+			f.err <- err
+			return
+		}
+		if err := conn.Handshake(capabilities); err != nil {
+			f.err <- err
+			return
+		}
+		f.conn <- conn
+	}()
+
+	return f
+}
+
+func TestTransferChecksumMismatch(t *testing.T) {
+	dir := useWorkDir(t)
+	sender := startFakeSender(t)
+
+	data := []byte("these bytes will not match the advertised digest")
+	senderResult := make(chan protocol.Frame, 1)
+	go func() {
+		var conn *protocol.Conn
+		select {
+		case conn = <-sender.conn:
+		case err := <-sender.err:
+			t.Errorf("fake sender failed: %v", err)
+			close(senderResult)
+			return
+		}
+		defer conn.Close()
+
+		conn.Send(protocol.MsgOffer, protocol.Offer{Files: []protocol.FileEntry{{Name: "corrupt.bin", Size: int64(len(data))}}})
+		if frame, err := conn.ReadFrame(); err != nil || frame.Type != protocol.MsgAccept {
+			t.Errorf("expected accept, got %v (%v)", frame.Type, err)
+			close(senderResult)
+			return
+		}
+		conn.Send(protocol.MsgFileStart, protocol.FileStart{Index: 0})
+		conn.WriteFrame(protocol.MsgData, data)
+		conn.Send(protocol.MsgFileDone, protocol.FileDone{Index: 0, Checksum: strings.Repeat("0", 64)})
+		conn.Send(protocol.MsgDone, protocol.Done{})
+
+		frame, _ := conn.ReadFrame()
+		senderResult <- frame
+	}()
+
+	conn, err := server.StartReceiver(sender.code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, context.Background())
+	final := drainReceiver(t, recvChan)
+
+	if final.Error != server.ErrChecksumMismatch {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", final.Error)
+	}
+	if len(final.Files) != 1 || final.Files[0].Checksum == "" {
+		t.Error("expected the computed checksum to be reported")
+	}
+
+	var reported protocol.Done
+	frame := <-senderResult
+	if frame.Type != protocol.MsgDone || frame.Decode(&reported) != nil ||
+		len(reported.Results) != 1 || reported.Results[0].Code != server.ErrChecksumMismatch.Code {
+		t.Errorf("sender was not told about the mismatch: %s %s", frame.Type, frame.Payload)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "corrupt.bin")); !os.IsNotExist(err) {
+		t.Error("corrupted file was left in place")
+	}
+}
+
+func TestTransferUnsafePath(t *testing.T) {
+	for _, names := range [][]string{
+		{"../escape.txt"},
+		{"/tmp/escape.txt"},
+		{"dir/../../escape.txt"},
+		{"C:/escape.txt"},
+		{"dir//escape.txt"},
+		{"same.txt", "same.txt"},
+	} {
+		t.Run(names[0], func(t *testing.T) {
+			useWorkDir(t)
+			sender := startFakeSender(t)
+
+			senderResult := make(chan protocol.Frame, 1)
+			go func() {
+				var conn *protocol.Conn
+				select {
+				case conn = <-sender.conn:
+				case err := <-sender.err:
+					t.Errorf("fake sender failed: %v", err)
+					close(senderResult)
+					return
+				}
+				defer conn.Close()
+
+				var offer protocol.Offer
+				for _, name := range names {
+					offer.Files = append(offer.Files, protocol.FileEntry{Name: name, Size: 1})
+				}
+				conn.Send(protocol.MsgOffer, offer)
+				frame, _ := conn.ReadFrame()
+				senderResult <- frame
+			}()
+
+			conn, err := server.StartReceiver(sender.code)
+			if err != nil {
+				t.Fatalf("failed to join session: %v", err)
+			}
+			defer conn.Close()
+			if _, err := server.ReceiveMetadata(conn); err == nil {
+				t.Fatal("expected the offer to be refused")
+			}
+
+			var reported protocol.Error
+			frame := <-senderResult
+			if frame.Type != protocol.MsgError || frame.Decode(&reported) != nil || reported.Code != server.ErrUnsafePath.Code {
+				t.Errorf("sender was not told about the unsafe name: %s %s", frame.Type, frame.Payload)
+			}
+		})
+	}
+}
+
+func TestTransferSanitizedNames(t *testing.T) {
+	dir := useWorkDir(t)
+	sender := startFakeSender(t, protocol.CapResume)
+
+	names := []string{"bad\x1b[31mname.txt", "CON.txt", "back\\slash.txt"}
+	go func() {
+		var conn *protocol.Conn
+		select {
+		case conn = <-sender.conn:
+		case err := <-sender.err:
+			t.Errorf("fake sender failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		var offer protocol.Offer
+		for _, name := range names {
+			offer.Files = append(offer.Files, protocol.FileEntry{Name: name, Size: 1})
+		}
+		conn.Send(protocol.MsgOffer, offer)
+		if frame, err := conn.ReadFrame(); err != nil || frame.Type != protocol.MsgAccept {
+			t.Errorf("expected accept, got %v (%v)", frame.Type, err)
+			return
+		}
+		for i := range names {
+			conn.Send(protocol.MsgFileStart, protocol.FileStart{Index: i})
+			conn.WriteFrame(protocol.MsgData, []byte{'x'})
+			conn.Send(protocol.MsgFileDone, protocol.FileDone{Index: i})
+		}
+		conn.Send(protocol.MsgDone, protocol.Done{})
+		conn.ReadFrame()
+	}()
+
+	conn, err := server.StartReceiver(sender.code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, context.Background())
+	if final := drainReceiver(t, recvChan); final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+
+	for _, name := range []string{"bad_[31mname.txt", "_CON.txt", "back_slash.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %q to be received: %v", name, err)
+		}
+	}
+}
+
+func TestTransferSymlinkEscape(t *testing.T) {
+	dir := useWorkDir(t)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	sender := startFakeSender(t)
+
+	senderResult := make(chan protocol.Frame, 1)
+	go func() {
+		var conn *protocol.Conn
+		select {
+		case conn = <-sender.conn:
+		case err := <-sender.err:
+			t.Errorf("fake sender failed: %v", err)
+			close(senderResult)
+			return
+		}
+		defer conn.Close()
+
+		conn.Send(protocol.MsgOffer, protocol.Offer{Files: []protocol.FileEntry{{Name: "link/escape.txt", Size: 1}}})
+		frame, _ := conn.ReadFrame()
+		senderResult <- frame
+	}()
+
+	conn, err := server.StartReceiver(sender.code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, context.Background())
+	if final := drainReceiver(t, recvChan); final.State != server.StateError {
+		t.Fatalf("expected the transfer to be refused, got state %d", final.State)
+	}
+
+	var reported protocol.Error
+	frame := <-senderResult
+	if frame.Type != protocol.MsgError || frame.Decode(&reported) != nil || reported.Code != server.ErrUnsafePath.Code {
+		t.Errorf("sender was not told about the unsafe name: %s %s", frame.Type, frame.Payload)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Error("file was written through the symlink")
+	}
+}
+
+func TestTransferInsufficientSpace(t *testing.T) {
+	dir := useWorkDir(t)
+	sender := startFakeSender(t)
+
+	const size = 1 << 60
+	senderResult := make(chan protocol.Frame, 1)
+	go func() {
+		var conn *protocol.Conn
+		select {
+		case conn = <-sender.conn:
+		case err := <-sender.err:
+			t.Errorf("fake sender failed: %v", err)
+			close(senderResult)
+			return
+		}
+		defer conn.Close()
+
+		conn.Send(protocol.MsgOffer, protocol.Offer{Files: []protocol.FileEntry{{Name: "huge.bin", Size: size}}})
+		frame, _ := conn.ReadFrame()
+		senderResult <- frame
+	}()
+
+	conn, err := server.StartReceiver(sender.code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if needed, _, ok := server.CheckSpace(meta, "."); ok || needed != size {
+		t.Errorf("expected the preflight to report %d missing bytes, got %d (ok %v)", int64(size), needed, ok)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, context.Background())
+	if final := drainReceiver(t, recvChan); final.State != server.StateError {
+		t.Fatalf("expected the transfer to be refused, got state %d", final.State)
+	}
+
+	var reject protocol.Reject
+	frame := <-senderResult
+	if frame.Type != protocol.MsgReject || frame.Decode(&reject) != nil || reject.Code != server.ErrInsufficientSpace.Code {
+		t.Errorf("sender was not told about the missing space: %s %s", frame.Type, frame.Payload)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Error("refused transfer left files behind")
+	}
+}
+
+func TestTransferStaleParts(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := useWorkDir(t)
+
+	files := writeParts(t, dir)
+
+	path, _ := writeTempFile(t, "payload.bin", 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	if final := drainReceiver(t, recvChan); final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	<-senderDone
+
+	checkParts(t, dir, files)
+}
+
+func TestCleanStalePartsAtStartup(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "project", "src")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	top, below := writeParts(t, root), writeParts(t, nested)
+
+	server.CleanStaleParts(root)
+
+	// Folders below are left for the transfers that write to them.
+	for i := range below {
+		below[i].kept = true
+	}
+	checkParts(t, root, top)
+	checkParts(t, nested, below)
+}
+
+type partFile struct {
+	name string
+	kept bool
+}
+
+// writeParts leaves partial files of past transfers in dir: stale and fresh
+// ones with their sidecars, and hidden .part files some other program wrote.
+func writeParts(t *testing.T, dir string) []partFile {
+	t.Helper()
+	expired := time.Now().Add(-server.PART_EXPIRY - time.Hour)
+	sidecar := []byte(`{"name":"old.bin","size":7}`)
+	files := []struct {
+		name  string
+		data  []byte
+		stale bool
+		kept  bool
+	}{
+		{".old.bin.part", []byte("partial"), true, false},
+		{".old.bin.part.json", sidecar, true, false},
+		{".gone.bin.part.json", sidecar, true, false},
+		{".fresh.bin.part", []byte("partial"), false, true},
+		{".fresh.bin.part.json", sidecar, true, true},
+		{".foreign.part", []byte("partial"), true, true},
+		{".foreign.part.json", []byte("not ours"), true, true},
+		{".orphan.bin.part", []byte("partial"), true, true},
+		{"notes.part", []byte("partial"), true, true},
+	}
+
+	var parts []partFile
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, f.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if f.stale {
+			os.Chtimes(path, expired, expired)
+		}
+		parts = append(parts, partFile{f.name, f.kept})
+	}
+	return parts
+}
+
+func checkParts(t *testing.T, dir string, parts []partFile) {
+	t.Helper()
+	for _, f := range parts {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if f.kept && err != nil {
+			t.Errorf("%s should have been kept: %v", f.name, err)
+		}
+		if !f.kept && !os.IsNotExist(err) {
+			t.Errorf("stale %s was not removed", f.name)
+		}
+	}
+}
+
+func TestTransferResume(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	useStreams(t, 1)
+	dir := useWorkDir(t)
+
+	path, data := writeTempFile(t, "large.bin", 16*1024*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+
+	rejoin := make(chan server.SendProgress, 1)
+	senderDone := make(chan server.SendProgress, 1)
+	go func() {
+		var last server.SendProgress
+		for p := range sendChan {
+			if p.State == server.StateWaitingForReceiver {
+				rejoin <- p
+			}
+			last = p
+		}
+		senderDone <- last
+	}()
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	for p := range recvChan {
+		if p.State == server.StateReceiving && p.BytesReceived > 0 {
+			conn.Close()
+		}
+	}
+
+	select {
+	case p := <-rejoin:
+		if p.BytesSent == 0 || p.Code != code {
+			t.Fatalf("unexpected interrupted state: %+v", p)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("sender did not wait for the receiver to rejoin")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".large.bin.part")); err != nil {
+		t.Fatalf("partial file was not kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "large.bin")); !os.IsNotExist(err) {
+		t.Fatal("interrupted file is visible under its final name")
+	}
+
+	conn, err = server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to rejoin session: %v", err)
+	}
+	meta, err = server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan = make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+
+	var resumedFrom int64 = -1
+	var final server.ReceiveProgress
+	for p := range recvChan {
+		if resumedFrom < 0 && p.State == server.StateReceiving {
+			resumedFrom = p.BytesReceived
+		}
+		final = p
+	}
+
+	if resumedFrom <= 0 {
+		t.Errorf("expected transfer to resume from a non-zero offset, got %d", resumedFrom)
+	}
+	if final.State != server.StateCompleted {
+		t.Fatalf("resumed transfer did not complete: state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "large.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("resumed file does not match the sent file")
+	}
+	for _, leftover := range []string{".large.bin.part", ".large.bin.part.json"} {
+		if _, err := os.Stat(filepath.Join(dir, leftover)); !os.IsNotExist(err) {
+			t.Errorf("%s was not cleaned up", leftover)
+		}
+	}
+}
+
+func TestTransferParallel(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	useStreams(t, 4)
+	dir := useWorkDir(t)
+
+	path, data := writeTempFile(t, "large.bin", 16*1024*1024+5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+
+	streams := 0
+	var final server.ReceiveProgress
+	for p := range recvChan {
+		streams = max(streams, p.Streams)
+		final = p
+	}
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if streams != 4 {
+		t.Errorf("expected the file to be sent over 4 streams, got %d", streams)
+	}
+	sent := <-senderDone
+	if sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "large.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received file does not match the sent file")
+	}
+
+	digest := sha256.Sum256(data)
+	checksum := hex.EncodeToString(digest[:])
+	if len(final.Files) != 1 || final.Files[0].Checksum != checksum || sent.Files[0].Checksum != checksum {
+		t.Errorf("unexpected file outcomes %+v and %+v", final.Files, sent.Files)
+	}
+}
+
+func TestTransferParallelFewerStreams(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	useStreams(t, 4)
+	useQUIC(t, false)
+	dir := useWorkDir(t)
+
+	// The receiver gets the main connection and one extra stream through
+	// before dialing fails.
+	var mu sync.Mutex
+	dials := 0
+	original := server.DialTCP
+	server.DialTCP = func(address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		dials++
+		refused := dials > 2
+		mu.Unlock()
+		if refused {
+			return nil, fmt.Errorf("connection to %s refused", address)
+		}
+		return original(address, timeout)
+	}
+	t.Cleanup(func() { server.DialTCP = original })
+
+	path, data := writeTempFile(t, "large.bin", 8*1024*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	started := time.Now()
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+
+	streams := 0
+	var final server.ReceiveProgress
+	for p := range recvChan {
+		streams = max(streams, p.Streams)
+		final = p
+	}
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if streams != 2 {
+		t.Errorf("expected the file to be sent over the 2 streams that opened, got %d", streams)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("sender waited %v for streams that were never opened", elapsed)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted || sent.Streams != 2 {
+		t.Fatalf("sender did not complete over 2 streams, got state %d over %d (%v)", sent.State, sent.Streams, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "large.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received file does not match the sent file")
+	}
+}
+
+func TestTransferParallelResume(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	useStreams(t, 4)
+	dir := useWorkDir(t)
+
+	path, data := writeTempFile(t, "large.bin", 32*1024*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+
+	rejoin := make(chan struct{}, 1)
+	senderDone := make(chan server.SendProgress, 1)
+	go func() {
+		var last server.SendProgress
+		for p := range sendChan {
+			if p.State == server.StateWaitingForReceiver {
+				rejoin <- struct{}{}
+			}
+			last = p
+		}
+		senderDone <- last
+	}()
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	for p := range recvChan {
+		if p.State == server.StateReceiving && p.BytesReceived > 8*1024*1024 {
+			conn.Close()
+		}
+	}
+
+	select {
+	case <-rejoin:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sender did not wait for the receiver to rejoin")
+	}
+
+	conn, err = server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to rejoin session: %v", err)
+	}
+	meta, err = server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan = make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	if final := drainReceiver(t, recvChan); final.State != server.StateCompleted {
+		t.Fatalf("resumed transfer did not complete: state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "large.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("resumed file does not match the sent file")
+	}
+}
+
+func TestTransferRateLimit(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := useWorkDir(t)
+
+	path, data := writeTempFile(t, "payload.bin", 2*1024*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	limiter := server.NewLimiter(64 * 1024)
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, limiter, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+
+	// How closely the limit is kept is up to TestLimiter; here it only has to
+	// hold the 2MB back until it is lifted.
+	start := time.Now()
+	var final server.ReceiveProgress
+	for p := range recvChan {
+		if p.State == server.StateReceiving && time.Since(start) > 500*time.Millisecond && limiter.Rate() > 0 {
+			limiter.SetRate(0)
+		}
+		final = p
+	}
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if limiter.Rate() != 0 {
+		t.Fatal("transfer finished before the limit was lifted")
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "payload.bin"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received file does not match the sent file")
+	}
+}
+
+func TestGlobalRateLimitSetting(t *testing.T) {
+	original := server.RATE_LIMIT
+	t.Cleanup(func() { server.SetGlobalRateLimit(original) })
+
+	server.RATE_LIMIT = 64 * 1024
+	if rate := server.GlobalRateLimit(); rate != 64*1024 {
+		t.Fatalf("expected the global limit to follow RATE_LIMIT, got %d", rate)
+	}
+
+	server.SetGlobalRateLimit(128 * 1024)
+	if server.RATE_LIMIT != 128*1024 || server.GlobalRateLimit() != 128*1024 {
+		t.Fatalf("expected RATE_LIMIT and the global limit to be 128KB/s, got %d and %d", server.RATE_LIMIT, server.GlobalRateLimit())
+	}
+}
+
+func TestTransferCompression(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := useWorkDir(t)
+
+	var log bytes.Buffer
+	for i := 0; log.Len() < 2*1024*1024; i++ {
+		fmt.Fprintf(&log, "2024-05-01T12:00:%02d INFO build step %d finished without errors\n", i%60, i)
+	}
+	logPath := filepath.Join(t.TempDir(), "build.log")
+	if err := os.WriteFile(logPath, log.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	randomPath, random := writeTempFile(t, "random.bin", 512*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{logPath, randomPath}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	sent := <-senderDone
+	if sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	for name, want := range map[string][]byte{"build.log": log.Bytes(), "random.bin": random} {
+		received, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(received, want) {
+			t.Errorf("received file %s does not match the sent file (%v)", name, err)
+		}
+	}
+
+	logical := int64(log.Len() + len(random))
+	if sent.BytesSent != logical || final.BytesReceived != logical {
+		t.Errorf("logical byte counts are off: sent %d, received %d, want %d", sent.BytesSent, final.BytesReceived, logical)
+	}
+	if sent.WireBytes != final.WireBytes {
+		t.Errorf("wire byte counts disagree: sent %d, received %d", sent.WireBytes, final.WireBytes)
+	}
+	if sent.WireBytes > int64(log.Len()/4+len(random)) {
+		t.Errorf("log was not compressed: %d wire bytes for %d logical bytes", sent.WireBytes, logical)
+	}
+	if sent.WireBytes < int64(len(random)) {
+		t.Errorf("random data cannot shrink below %d bytes, got %d wire bytes", len(random), sent.WireBytes)
+	}
+}
+
+func TestTransferGzip(t *testing.T) {
+	dir := useWorkDir(t)
+	sender := startFakeSender(t, protocol.CapSHA256, protocol.CapGzip)
+
+	data := bytes.Repeat([]byte("gzip compressed line\n"), 4096)
+	digest := sha256.Sum256(data)
+
+	var packed bytes.Buffer
+	writer := gzip.NewWriter(&packed)
+	writer.Write(data)
+	writer.Close()
+
+	senderResult := make(chan protocol.Frame, 1)
+	go func() {
+		var conn *protocol.Conn
+		select {
+		case conn = <-sender.conn:
+		case err := <-sender.err:
+			t.Errorf("fake sender failed: %v", err)
+			close(senderResult)
+			return
+		}
+		defer conn.Close()
+
+		conn.Send(protocol.MsgOffer, protocol.Offer{Files: []protocol.FileEntry{{Name: "lines.txt", Size: int64(len(data))}}})
+		if frame, err := conn.ReadFrame(); err != nil || frame.Type != protocol.MsgAccept {
+			t.Errorf("expected accept, got %v (%v)", frame.Type, err)
+			close(senderResult)
+			return
+		}
+		conn.Send(protocol.MsgFileStart, protocol.FileStart{Index: 0, Compression: protocol.CapGzip})
+		conn.WriteFrame(protocol.MsgCompressed, packed.Bytes())
+		conn.Send(protocol.MsgFileDone, protocol.FileDone{Index: 0, Checksum: hex.EncodeToString(digest[:])})
+		conn.Send(protocol.MsgDone, protocol.Done{})
+
+		frame, _ := conn.ReadFrame()
+		senderResult <- frame
+	}()
+
+	conn, err := server.StartReceiver(sender.code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, context.Background())
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if final.WireBytes != int64(packed.Len()) {
+		t.Errorf("expected %d wire bytes, got %d", packed.Len(), final.WireBytes)
+	}
+
+	if frame := <-senderResult; frame.Type != protocol.MsgDone {
+		t.Errorf("expected done, got %s", frame.Type)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "lines.txt"))
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("decompressed file does not match (%v)", err)
+	}
+}
+
+func TestTransferStream(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	useStreams(t, 4)
+
+	data := make([]byte, 6*1024*1024+5)
+	rand.Read(data)
+	reader, writer := io.Pipe()
+	go func() {
+		for chunk := range slices.Chunk(data, 10000) {
+			writer.Write(chunk)
+		}
+		writer.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartStreamSender("dump.sql", reader, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if len(meta.Files) != 1 || !meta.Files[0].Stream || meta.Size != 0 {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	var out bytes.Buffer
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveStream(conn, meta, &out, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("received stream does not match the sent data")
+	}
+	if len(final.Files) != 1 || final.Files[0].Size != int64(len(data)) {
+		t.Errorf("unexpected file outcomes %+v", final.Files)
+	}
+}
+
+func TestTransferStreamToFile(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := useWorkDir(t)
+
+	data := bytes.Repeat([]byte("streamed line\n"), 20000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartStreamSender("notes.txt", bytes.NewReader(data), nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, ".", server.Conflicts{}, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "notes.txt"))
+	if err != nil {
+		t.Fatalf("received file missing: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received file does not match the sent stream")
+	}
+}
+
+func TestTransferText(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+	dir := t.TempDir()
+
+	text := "panic: runtime error: index out of range [3] with length 3\n\ngoroutine 1 [running]:\nmain.main()\n"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartTextSender(text, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if !server.IsText(meta) || meta.Size != int64(len(text)) {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	var out bytes.Buffer
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveStream(conn, meta, &out, nil, recvChan, ctx)
+	final := drainReceiver(t, recvChan)
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+	if out.String() != text {
+		t.Fatalf("received text %q, want %q", out.String(), text)
+	}
+
+	first, err := server.SaveText(meta, dir, out.Bytes())
+	if err != nil {
+		t.Fatalf("failed to save text: %v", err)
+	}
+	second, err := server.SaveText(meta, dir, out.Bytes())
+	if err != nil {
+		t.Fatalf("failed to save text again: %v", err)
+	}
+	if first != filepath.Join(dir, "snippet.txt") || second != filepath.Join(dir, "snippet (1).txt") {
+		t.Errorf("saved text as %s and %s", first, second)
+	}
+	if saved, err := os.ReadFile(second); err != nil || string(saved) != text {
+		t.Errorf("saved text does not match (%v)", err)
+	}
+}
+
+func TestTransferMultiReceiver(t *testing.T) {
+	startRelay(t)
+	path, data := writeTempFile(t, "artifact.bin", 512*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartMultiSender([]string{path}, server.MultiOptions{MaxReceivers: 3}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+
+	rows := make(chan map[int]server.SendProgress, 1)
+	go func() {
+		last := make(map[int]server.SendProgress)
+		for p := range sendChan {
+			last[p.Receiver] = p
+		}
+		rows <- last
+	}()
+
+	var conns []*server.ReceiverConn
+	for range 3 {
+		conn, err := server.StartReceiver(code)
+		if err != nil {
+			t.Fatalf("failed to join session: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	if _, err := server.StartReceiver(code); err != server.ErrSessionFull {
+		t.Fatalf("expected a full session for the fourth receiver, got %v", err)
+	}
+
+	dirs := make([]string, len(conns))
+	finals := make(chan server.ReceiveProgress, len(conns))
+	for i, conn := range conns {
+		dirs[i] = t.TempDir()
+		go func() {
+			meta, err := server.ReceiveMetadata(conn)
+			if err != nil {
+				finals <- server.ReceiveProgress{State: server.StateError, Error: err}
+				return
+			}
+			recvChan := make(chan server.ReceiveProgress)
+			server.ReceiveFile(conn, meta, dirs[i], server.Conflicts{}, nil, recvChan, ctx)
+			finals <- drainReceiver(t, recvChan)
+		}()
+	}
+	for range conns {
+		if final := <-finals; final.State != server.StateCompleted {
+			t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+		}
+	}
+
+	var last map[int]server.SendProgress
+	select {
+	case last = <-rows:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender did not close the session after its last receiver")
+	}
+	if last[0].State != server.StateCompleted {
+		t.Errorf("session ended in state %d (%v)", last[0].State, last[0].Error)
+	}
+	for receiver := 1; receiver <= 3; receiver++ {
+		if p := last[receiver]; p.State != server.StateCompleted || p.ReceiverAddr == "" {
+			t.Errorf("receiver %d ended in state %d from %q (%v)", receiver, p.State, p.ReceiverAddr, p.Error)
+		}
+	}
+
+	for _, dir := range dirs {
+		received, err := os.ReadFile(filepath.Join(dir, "artifact.bin"))
+		if err != nil || !bytes.Equal(received, data) {
+			t.Errorf("received file in %s does not match the sent file (%v)", dir, err)
+		}
+	}
+}
+
+func TestTransferMultiReceiverTimeout(t *testing.T) {
+	startRelay(t)
+	path, _ := writeTempFile(t, "artifact.bin", 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartMultiSender([]string{path}, server.MultiOptions{Timeout: 300 * time.Millisecond}, nil, sendChan, ctx)
+	waitForSession(t, sendChan)
+
+	select {
+	case final := <-drainSender(sendChan):
+		if final.State != server.StateCompleted || final.Receiver != 0 {
+			t.Errorf("session ended in state %d (%v)", final.State, final.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session stayed open past its timeout")
+	}
+}
+
+func TestTransferMultiReceiverWrongCode(t *testing.T) {
+	startRelay(t)
+	path, _ := writeTempFile(t, "artifact.bin", 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartMultiSender([]string{path}, server.MultiOptions{}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	sessionID, secret, err := server.SplitCode(code)
+	if err != nil || len(secret) < 12 {
+		t.Fatalf("expected a long secret for a multi-receiver code, got %q (%v)", code, err)
+	}
+	for range 3 {
+		if _, err := server.StartReceiver(sessionID + "-000000000000"); err != server.ErrWrongCode {
+			t.Fatalf("expected ErrWrongCode for receiver, got %v", err)
+		}
+	}
+
+	select {
+	case final := <-senderDone:
+		if final.Error != server.ErrTooManyAttempts {
+			t.Errorf("expected the session to end after failed attempts, got state %d (%v)", final.State, final.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session stayed open after repeated wrong codes")
+	}
+}
+
+func TestTransferMultiReceiverStrayConnections(t *testing.T) {
+	startRelay(t)
+	path, data := writeTempFile(t, "artifact.bin", 1024)
+
+	port := freePort(t)
+	original := server.TRANSFER_PORT
+	server.TRANSFER_PORT = port
+	t.Cleanup(func() { server.TRANSFER_PORT = original })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartMultiSender([]string{path}, server.MultiOptions{MaxReceivers: 1}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	// Connections that drop before the key exchange are not wrong codes.
+	for range 5 {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatalf("failed to reach the sender: %v", err)
+		}
+		conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session after stray connections: %v", err)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	dir := t.TempDir()
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, dir, server.Conflicts{}, nil, recvChan, ctx)
+	if final := drainReceiver(t, recvChan); final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+
+	select {
+	case final := <-senderDone:
+		if final.State != server.StateCompleted {
+			t.Errorf("session ended in state %d (%v)", final.State, final.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender did not close the session after its last receiver")
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "artifact.bin"))
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("received file does not match the sent file (%v)", err)
+	}
+}
+
+func TestTransferRequest(t *testing.T) {
+	startRelay(t)
+	path, data := writeTempFile(t, "report.pdf", 256*1024)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request, err := server.CreateRequest(ctx)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	if _, err := server.StartReceiver(request.Code); err != server.ErrRequestCode {
+		t.Fatalf("expected joining a request to fail, got %v", err)
+	}
+
+	waited := make(chan *server.ReceiverConn, 1)
+	go func() {
+		conn, err := request.Wait(ctx)
+		if err != nil {
+			t.Errorf("failed waiting for sender: %v", err)
+		}
+		waited <- conn
+	}()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartRequestSender(request.Code, []string{path}, nil, sendChan, ctx)
+	if code := waitForSession(t, sendChan); code != request.Code {
+		t.Fatalf("sender answered %s, want %s", code, request.Code)
+	}
+	senderDone := drainSender(sendChan)
+
+	second := make(chan server.SendProgress)
+	server.StartRequestSender(request.Code, []string{path}, nil, second, ctx)
+	if final := <-drainSender(second); final.Error != server.ErrRequestAnswered {
+		t.Errorf("expected a second sender to be refused, got %v", final.Error)
+	}
+
+	conn := <-waited
+	if conn == nil {
+		t.FailNow()
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+	if meta.Name != "report.pdf" || meta.Size != int64(len(data)) {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, dir, server.Conflicts{}, nil, recvChan, ctx)
+	if final := drainReceiver(t, recvChan); final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "report.pdf"))
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("received file does not match the sent file (%v)", err)
+	}
+
+	offer := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, offer, ctx)
+	offerCode := waitForSession(t, offer)
+	answer := make(chan server.SendProgress)
+	server.StartRequestSender(offerCode, []string{path}, nil, answer, ctx)
+	if final := <-drainSender(answer); final.Error != server.ErrNotARequest {
+		t.Errorf("expected answering an offer to fail, got %v", final.Error)
+	}
+	cancel()
+	<-drainSender(offer)
+}
+
+func useQUIC(t *testing.T, enabled bool) {
+	original := server.QUIC
+	server.QUIC = enabled
+	t.Cleanup(func() { server.QUIC = original })
+}
+
+// transferOver sends an 8MB file to a receiver that joins after setup ran
+// and checks it arrived over transport, split across 4 streams.
+func transferOver(t *testing.T, setup func(), transport string) {
+	t.Helper()
+	useStreams(t, 4)
+	dir := t.TempDir()
+	path, data := writeTempFile(t, "large.bin", 8*1024*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendChan := make(chan server.SendProgress)
+	server.StartSender([]string{path}, nil, sendChan, ctx)
+	code := waitForSession(t, sendChan)
+	senderDone := drainSender(sendChan)
+
+	setup()
+	conn, err := server.StartReceiver(code)
+	if err != nil {
+		t.Fatalf("failed to join session: %v", err)
+	}
+	if conn.Transport() != transport {
+		t.Errorf("connected over %s, want %s", conn.Transport(), transport)
+	}
+	meta, err := server.ReceiveMetadata(conn)
+	if err != nil {
+		t.Fatalf("failed to receive metadata: %v", err)
+	}
+
+	recvChan := make(chan server.ReceiveProgress)
+	server.ReceiveFile(conn, meta, dir, server.Conflicts{}, nil, recvChan, ctx)
+
+	streams := 0
+	var final server.ReceiveProgress
+	for p := range recvChan {
+		streams = max(streams, p.Streams)
+		final = p
+	}
+	if final.State != server.StateCompleted {
+		t.Fatalf("expected completed transfer, got state %d (%v)", final.State, final.Error)
+	}
+	if streams != 4 {
+		t.Errorf("expected the file to be sent over 4 streams, got %d", streams)
+	}
+	if sent := <-senderDone; sent.State != server.StateCompleted {
+		t.Fatalf("sender did not complete, got state %d (%v)", sent.State, sent.Error)
+	}
+
+	received, err := os.ReadFile(filepath.Join(dir, "large.bin"))
+	if err != nil || !bytes.Equal(received, data) {
+		t.Errorf("received file does not match the sent file (%v)", err)
+	}
+}
+
+func TestTransferQUIC(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	tests := []struct {
+		name      string
+		receiver  bool
+		transport string
+	}{
+		{"quic", true, "quic"},
+		{"tcp_fallback", false, "tcp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useQUIC(t, true)
+			transferOver(t, func() { server.QUIC = tt.receiver }, tt.transport)
+		})
+	}
+}
+
+// useWebRTC enables WebRTC with ICE limited to loopback candidates, so both
+// peers in a test find each other without a STUN server.
+func useWebRTC(t *testing.T, enabled bool) {
+	original, servers, loopback := server.WEBRTC, server.ICE_SERVERS, server.WEBRTC_LOOPBACK
+	server.WEBRTC, server.ICE_SERVERS, server.WEBRTC_LOOPBACK = enabled, nil, true
+	t.Cleanup(func() {
+		server.WEBRTC, server.ICE_SERVERS, server.WEBRTC_LOOPBACK = original, servers, loopback
+	})
+}
+
+func TestTransferWebRTC(t *testing.T) {
+	startRelay(t)
+	useQUIC(t, false)
+	usePunch(t, false)
+
+	tests := []struct {
+		name      string
+		receiver  bool
+		blocked   bool
+		transport string
+	}{
+		{"webrtc", true, true, "webrtc"},
+		{"direct_first", true, false, "tcp"},
+		{"tcp_fallback", false, false, "tcp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useWebRTC(t, true)
+			if tt.blocked {
+				blockTCP(t)
+			}
+			transferOver(t, func() { server.WEBRTC = tt.receiver }, tt.transport)
+		})
+	}
+}
+
+// blockTCP makes direct TCP connections to the peer fail, as on a network
+// that only lets the NAT traversing transports through.
+func blockTCP(t *testing.T) {
+	original := server.DialTCP
+	server.DialTCP = func(address string, timeout time.Duration) (net.Conn, error) {
+		return nil, fmt.Errorf("connection to %s blocked", address)
+	}
+	t.Cleanup(func() { server.DialTCP = original })
+}
+
+func usePunch(t *testing.T, enabled bool) {
+	original := server.PUNCH
+	server.PUNCH = enabled
+	t.Cleanup(func() { server.PUNCH = original })
+}
+
+// natConn is a UDP socket behind a simulated port-restricted cone NAT:
+// packets only get in from addresses the socket sent to first.
+type natConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	sent map[string]bool
+}
+
+func (c *natConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sent[addr.String()] = true
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *natConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		c.mu.Lock()
+		allowed := c.sent[addr.String()]
+		c.mu.Unlock()
+		if allowed {
+			return n, addr, nil
+		}
+	}
+}
+
+// useNAT puts the sockets both peers punch holes from behind simulated NATs.
+func useNAT(t *testing.T) {
+	original := server.ListenUDP
+	server.ListenUDP = func() (net.PacketConn, error) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		return &natConn{PacketConn: conn, sent: make(map[string]bool)}, nil
+	}
+	t.Cleanup(func() { server.ListenUDP = original })
+}
+
+func TestTransferHolePunch(t *testing.T) {
+	startRelay(t)
+	useQUIC(t, false)
+	useWebRTC(t, false)
+	useNAT(t)
+
+	t.Run("nat_drops_unsolicited", func(t *testing.T) {
+		conn, err := server.ListenUDP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		outside, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer outside.Close()
+
+		outside.WriteTo([]byte("unsolicited"), conn.LocalAddr())
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, _, err := conn.ReadFrom(make([]byte, 64)); err == nil {
+			t.Fatal("simulated NAT let in a packet from an address it never sent to")
+		}
+	})
+
+	tests := []struct {
+		name      string
+		receiver  bool
+		blocked   bool
+		transport string
+	}{
+		{"punched", true, true, "udp"},
+		{"direct_first", true, false, "tcp"},
+		{"tcp_fallback", false, false, "tcp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usePunch(t, true)
+			if tt.blocked {
+				blockTCP(t)
+			}
+			transferOver(t, func() { server.PUNCH = tt.receiver }, tt.transport)
+		})
+	}
+}
+
+// useDiscovery turns LAN discovery on or off, on a port of the test's own
+// when on.
+func useDiscovery(t *testing.T, enabled bool) {
+	original, port := server.DISCOVERY, server.DISCOVERY_PORT
+	server.DISCOVERY = enabled
+	if enabled {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, server.DISCOVERY_PORT, _ = net.SplitHostPort(conn.LocalAddr().String())
+		conn.Close()
+	}
+	t.Cleanup(func() { server.DISCOVERY, server.DISCOVERY_PORT = original, port })
+}
+
+func TestLANDiscovery(t *testing.T) {
+	originalServer := server.RELAY_SERVER
+	originalProtocol := server.RELAY_PROTOCOL
+	server.RELAY_SERVER = "127.0.0.1:" + freePort(t)
+	server.RELAY_PROTOCOL = "http"
+	t.Cleanup(func() {
+		server.RELAY_SERVER = originalServer
+		server.RELAY_PROTOCOL = originalProtocol
+	})
+	useDiscovery(t, true)
+	useWebRTC(t, false)
+	usePunch(t, false)
+
+	tests := []struct {
+		name      string
+		receiver  bool
+		transport string
+	}{
+		{"quic", true, "quic"},
+		{"tcp_fallback", false, "tcp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useQUIC(t, true)
+			transferOver(t, func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				defer cancel()
+
+				found, err := server.Browse(ctx)
+				if err != nil {
+					t.Fatalf("failed to browse: %v", err)
+				}
+				nearby, ok := <-found
+				if !ok {
+					t.Fatal("no sender answered on the local network")
+				}
+				if nearby.Host == "" || len(nearby.Addrs) == 0 || nearby.Port == "" {
+					t.Errorf("incomplete answer from nearby sender: %+v", nearby)
+				}
+
+				server.QUIC = tt.receiver
+			}, tt.transport)
+		})
+	}
+}
+
+// TestLANDiscoveryImpostor has something other than the sender answer for
+// the session on the local network; the receiver must still reach the
+// sender through the relay.
+func TestLANDiscoveryImpostor(t *testing.T) {
+	mock := NewMockRelayServer(true)
+	defer mock.Close()
+	useRelay(t, mock)
+
+	transferOver(t, func() {
+		useDiscovery(t, true)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+		responder, err := net.ListenPacket("udp4", ":"+server.DISCOVERY_PORT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { responder.Close() })
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, addr, err := responder.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				var query struct {
+					Session string `json:"session"`
+				}
+				if json.Unmarshal(buf[:n], &query) != nil || query.Session == "" {
+					continue
+				}
+				reply, _ := json.Marshal(server.Nearby{SessionID: query.Session, Addrs: []string{"127.0.0.1"}, Port: port})
+				responder.WriteTo(reply, addr)
+			}
+		}()
+	}, "quic")
+}
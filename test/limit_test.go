@@ -0,0 +1,86 @@
+package test
+
+import (
+	"context"
+	"ft_0/server"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock moves time forward by whatever a limiter waits for instead of
+// waiting, so how long a limiter held transfers back is exact.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	ready := make(chan time.Time, 1)
+	ready <- c.now
+	return ready
+}
+
+func (c *fakeClock) elapsed(since time.Time) time.Duration {
+	return c.Now().Sub(since)
+}
+
+func TestLimiter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	limiter := server.NewLimiterClock(1024*1024, clock)
+	ctx := context.Background()
+
+	// The first chunk goes out at once, each of the other 15 waits 32KB/1MB/s.
+	start := clock.Now()
+	for range 16 {
+		if err := limiter.Wait(ctx, 32*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed, want := clock.elapsed(start), 15*time.Second/32; elapsed < want-time.Millisecond || elapsed > want+time.Millisecond {
+		t.Errorf("512KB at 1MB/s took %v, want %v", elapsed, want)
+	}
+
+	limiter.SetRate(0)
+	start = clock.Now()
+	for range 64 {
+		if err := limiter.Wait(ctx, 32*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := clock.elapsed(start); elapsed != 0 {
+		t.Errorf("unlimited limiter still throttled for %v", elapsed)
+	}
+
+	limiter.SetRate(64 * 1024)
+	start = clock.Now()
+	for range 3 {
+		if err := limiter.Wait(ctx, 32*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed, want := clock.elapsed(start), time.Second; elapsed < want-time.Millisecond || elapsed > want+time.Millisecond {
+		t.Errorf("96KB at 64KB/s took %v, want %v", elapsed, want)
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	limiter := server.NewLimiter(1024)
+	ctx := context.Background()
+
+	limiter.Wait(ctx, 64*1024)
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(cancelled, 1); err == nil {
+		t.Error("expected Wait to stop when the context is cancelled")
+	}
+}
@@ -0,0 +1,199 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"ft_0/protocol"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func securePair(t *testing.T, senderCode, receiverCode string) (*protocol.Conn, *protocol.Conn, *recordingConn, error) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	wire := &recordingConn{Conn: a}
+	sender, receiver := protocol.NewConn(wire), protocol.NewConn(b)
+
+	errChan := make(chan error, 1)
+	go func() {
+		if err := sender.Secure(senderCode, "abc123", false); err != nil {
+			errChan <- err
+			return
+		}
+		errChan <- sender.Handshake(nil)
+	}()
+
+	err := receiver.Secure(receiverCode, "abc123", true)
+	if err == nil {
+		err = receiver.Handshake(nil)
+	}
+	if err != nil {
+		a.Close()
+		<-errChan
+		return nil, nil, nil, err
+	}
+	return sender, receiver, wire, <-errChan
+}
+
+func TestProtocolFraming(t *testing.T) {
+	t.Run("offer_round_trip", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		sender, receiver := protocol.NewConn(a), protocol.NewConn(b)
+		offer := protocol.Offer{Files: []protocol.FileEntry{
+			{Name: "weird|name\nwith newline.txt", Size: 42},
+			{Name: "second.txt", Size: 7, ModTime: 1700000000},
+		}}
+
+		go sender.Send(protocol.MsgOffer, offer)
+
+		frame, err := receiver.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if frame.Type != protocol.MsgOffer {
+			t.Fatalf("expected offer, got %s", frame.Type)
+		}
+
+		var got protocol.Offer
+		if err := frame.Decode(&got); err != nil {
+			t.Fatalf("failed to decode offer: %v", err)
+		}
+		if !reflect.DeepEqual(got, offer) {
+			t.Errorf("offer mismatch: got %+v, want %+v", got, offer)
+		}
+	})
+
+	t.Run("handshake_negotiates_capabilities", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		sender, receiver := protocol.NewConn(a), protocol.NewConn(b)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- sender.Handshake([]string{"alpha", "beta"})
+		}()
+
+		if err := receiver.Handshake([]string{"beta", "gamma"}); err != nil {
+			t.Fatalf("receiver handshake failed: %v", err)
+		}
+		if err := <-errChan; err != nil {
+			t.Fatalf("sender handshake failed: %v", err)
+		}
+
+		if !sender.Supports("beta") || !receiver.Supports("beta") {
+			t.Error("shared capability was not negotiated")
+		}
+		if sender.Supports("alpha") || receiver.Supports("gamma") {
+			t.Error("capability supported by only one peer was negotiated")
+		}
+	})
+
+	t.Run("version_mismatch", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		peer := protocol.NewConn(a)
+		go func() {
+			peer.Send(protocol.MsgHello, protocol.Hello{Version: protocol.Version + 1})
+			peer.ReadFrame()
+		}()
+
+		err := protocol.NewConn(b).Handshake(nil)
+		if err == nil || !strings.Contains(err.Error(), "unsupported protocol version") {
+			t.Fatalf("expected version error, got %v", err)
+		}
+	})
+
+	t.Run("oversized_frame", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		go func() {
+			var header [5]byte
+			header[0] = byte(protocol.MsgData)
+			binary.BigEndian.PutUint32(header[1:], 2*protocol.MaxFrameSize)
+			a.Write(header[:])
+		}()
+
+		if _, err := protocol.NewConn(b).ReadFrame(); err == nil {
+			t.Fatal("expected an error for an oversized frame")
+		}
+	})
+}
+
+func TestProtocolEncryption(t *testing.T) {
+	t.Run("frames_are_encrypted", func(t *testing.T) {
+		sender, receiver, wire, err := securePair(t, "abc123-f00d42", "abc123-f00d42")
+		if err != nil {
+			t.Fatalf("secure handshake failed: %v", err)
+		}
+
+		secret := []byte("top secret customer artifact")
+		go sender.WriteFrame(protocol.MsgData, secret)
+
+		frame, err := receiver.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if frame.Type != protocol.MsgData || !bytes.Equal(frame.Payload, secret) {
+			t.Fatalf("unexpected frame %s: %q", frame.Type, frame.Payload)
+		}
+
+		wire.mu.Lock()
+		defer wire.mu.Unlock()
+		if bytes.Contains(wire.written.Bytes(), secret) {
+			t.Error("plaintext found on the wire")
+		}
+	})
+
+	t.Run("wrong_code", func(t *testing.T) {
+		_, _, _, err := securePair(t, "abc123-f00d42", "abc123-badbad")
+		if err == nil || !strings.Contains(err.Error(), protocol.ErrAuthFailed.Error()) {
+			t.Fatalf("expected authentication failure, got %v", err)
+		}
+	})
+
+	t.Run("version_mismatch", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+
+		peer := protocol.NewConn(a)
+		go func() {
+			peer.Send(protocol.MsgKeyExchange, protocol.KeyExchange{Version: protocol.Version + 1, Share: make([]byte, 32)})
+			peer.ReadFrame()
+		}()
+
+		err := protocol.NewConn(b).Secure("abc123-f00d42", "abc123", true)
+		if !errors.Is(err, protocol.ErrIncompatibleVersion) {
+			t.Fatalf("expected version error before decrypting anything, got %v", err)
+		}
+	})
+}
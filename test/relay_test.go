@@ -0,0 +1,253 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"ft_0/protocol"
+	"ft_0/server"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func startRelay(t *testing.T) *server.RelayServer {
+	originalServer := server.RELAY_SERVER
+	originalProtocol := server.RELAY_PROTOCOL
+	server.RELAY_SERVER = "127.0.0.1:" + freePort(t)
+	server.RELAY_PROTOCOL = "http"
+	useDiscovery(t, false)
+
+	relay := server.NewRelayServer()
+	relay.Start()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.CheckRelayLogs(relay)()
+			}
+		}
+	}()
+
+	t.Cleanup(func() {
+		relay.Stop()
+		close(done)
+		server.RELAY_SERVER = originalServer
+		server.RELAY_PROTOCOL = originalProtocol
+	})
+
+	for i := 0; i < 50; i++ {
+		if resp, err := http.Get("http://" + server.RELAY_SERVER + "/join/"); err == nil {
+			resp.Body.Close()
+			return relay
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("relay server did not start")
+	return nil
+}
+
+func TestRelayForwarding(t *testing.T) {
+	sender := startFakeSender(t)
+
+	payload := bytes.Repeat([]byte("relayed "), 64*1024)
+	senderErr := make(chan error, 1)
+	go func() {
+		var conn *protocol.Conn
+		select {
+		case conn = <-sender.conn:
+		case err := <-sender.err:
+			senderErr <- err
+			return
+		}
+		defer conn.Close()
+		for chunk := range slices.Chunk(payload, server.CHUNK_SIZE) {
+			if err := conn.WriteFrame(protocol.MsgData, chunk); err != nil {
+				senderErr <- err
+				return
+			}
+		}
+		senderErr <- conn.Send(protocol.MsgDone, protocol.Done{})
+	}()
+
+	conn, err := server.StartReceiver(sender.code)
+	if err != nil {
+		t.Fatalf("receiver did not fall back to the relay: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var received []byte
+	for {
+		frame, err := conn.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read relayed data: %v", err)
+		}
+		if frame.Type == protocol.MsgDone {
+			break
+		}
+		received = append(received, frame.Payload...)
+	}
+	if err := <-senderErr; err != nil {
+		t.Fatalf("sender failed: %v", err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("relayed data mismatch: got %d bytes, want %d", len(received), len(payload))
+	}
+}
+
+func TestRelayForwardingUnknownSession(t *testing.T) {
+	startRelay(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := server.DialRelayPipe(ctx, "ffffff", "sender"); err != server.ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestRelaySignal(t *testing.T) {
+	startRelay(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, err := server.NewSessionManager().CreateSession(ctx, nil, freePort(t))
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	url := "http://" + server.RELAY_SERVER + "/signal/" + session.SessionID + "?to=sender"
+	offer := []byte(`{"from":"offer-1","description":{"type":"offer","sdp":"v=0"}}`)
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 for a posted signal, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, offer) {
+		t.Fatalf("expected the posted signal back, got %d %q", resp.StatusCode, body)
+	}
+
+	// Leaving the session drops its mailboxes along with what waits in them.
+	resp, err = http.Post(url, "application/json", bytes.NewReader(offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get("http://" + server.RELAY_SERVER + "/leave/" + session.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client := &http.Client{Timeout: 300 * time.Millisecond}
+	if resp, err := client.Get(url); err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Fatalf("expected the mailbox to be gone after leaving, got %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Post("http://"+server.RELAY_SERVER+"/signal/ffffff?to=sender", "application/json", bytes.NewReader(offer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown session, got %d", resp.StatusCode)
+	}
+}
+
+func TestRelayRendezvous(t *testing.T) {
+	startRelay(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, err := server.NewSessionManager().CreateSession(ctx, nil, freePort(t))
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", server.RELAY_SERVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	register := func(conn net.PacketConn, sessionID, role string) map[string]any {
+		t.Helper()
+		req := fmt.Sprintf(`{"session":%q,"role":%q,"local":["10.0.0.2:4000"]}`, sessionID, role)
+		if _, err := conn.WriteTo([]byte(req), relay); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("relay did not answer the registration: %v", err)
+		}
+		var reply map[string]any
+		if err := json.Unmarshal(buf[:n], &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	reply := register(sender, session.SessionID, "sender")
+	if reply["observed"] != sender.LocalAddr().String() {
+		t.Errorf("expected observed address %s, got %v", sender.LocalAddr(), reply["observed"])
+	}
+	if reply["peer"] != nil {
+		t.Errorf("expected no peer before the receiver registered, got %v", reply["peer"])
+	}
+
+	reply = register(receiver, session.SessionID, "receiver")
+	peer, _ := reply["peer"].([]any)
+	if len(peer) != 2 || peer[0] != sender.LocalAddr().String() || peer[1] != "10.0.0.2:4000" {
+		t.Errorf("expected the sender's observed and local candidates, got %v", reply["peer"])
+	}
+
+	reply = register(sender, "ffffff", "sender")
+	if reply["error"] != server.ErrSessionNotFound.Code {
+		t.Errorf("expected %s for an unknown session, got %v", server.ErrSessionNotFound.Code, reply)
+	}
+}
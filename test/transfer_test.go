@@ -40,9 +40,15 @@ func (m *MockRelayServer) handleNew(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var endpoint server.TransferSession
+	json.NewDecoder(r.Body).Decode(&endpoint)
+
 	session := server.TransferSession{
-		SessionID: server.GenerateID(),
-		SenderID:  "test-sender",
+		SessionID:   server.GenerateID(),
+		SenderID:    "test-sender",
+		SenderAddrs: endpoint.SenderAddrs,
+		SenderPort:  endpoint.SenderPort,
+		QUICPort:    endpoint.QUICPort,
 	}
 	m.sessions.Store(session.SessionID, &session)
 	json.NewEncoder(w).Encode(session)
@@ -87,6 +93,7 @@ func (m *MockRelayServer) Close() {
 }
 
 func TestSenderErrorHandling(t *testing.T) {
+	useDiscovery(t, false)
 	originalServer := server.RELAY_SERVER
 	originalProtocol := server.RELAY_PROTOCOL
 	defer func() {
@@ -168,7 +175,7 @@ func TestSenderErrorHandling(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
-			go server.StartSender(filepath, progressChan, ctx)
+			go server.StartSender([]string{filepath}, nil, progressChan, ctx)
 
 			var lastError error
 			done := make(chan bool)
@@ -260,28 +267,34 @@ func TestSessionManager(t *testing.T) {
 
 	t.Run("create_session", func(t *testing.T) {
 		ctx := context.Background()
-		session, err := sm.CreateSession(ctx)
+		session, err := sm.CreateSession(ctx, []string{"192.0.2.10"}, "4001")
 		if err != nil {
-			t.Errorf("Failed to create session: %v", err)
+			t.Fatalf("Failed to create session: %v", err)
 		}
 		if session.SessionID == "" {
 			t.Error("Session ID should not be empty")
 		}
+		if len(session.SenderAddrs) != 1 || session.SenderAddrs[0] != "192.0.2.10" || session.SenderPort != "4001" {
+			t.Errorf("Sender endpoint not published, got %v:%s", session.SenderAddrs, session.SenderPort)
+		}
 	})
 
 	t.Run("join_session", func(t *testing.T) {
 		ctx := context.Background()
-		session, err := sm.CreateSession(ctx)
+		session, err := sm.CreateSession(ctx, []string{"192.0.2.10"}, "4001")
 		if err != nil {
 			t.Fatalf("Failed to create session: %v", err)
 		}
 
 		joinedSession, err := sm.JoinSession(ctx, session.SessionID)
 		if err != nil {
-			t.Errorf("Failed to join session: %v", err)
+			t.Fatalf("Failed to join session: %v", err)
 		}
 		if joinedSession.SessionID != session.SessionID {
 			t.Error("Joined session ID doesn't match created session")
 		}
+		if joinedSession.SenderPort != "4001" || len(joinedSession.SenderAddrs) == 0 {
+			t.Errorf("Joined session is missing the sender endpoint: %+v", joinedSession)
+		}
 	})
 }
\ No newline at end of file
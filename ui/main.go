@@ -11,7 +11,9 @@ type Model struct {
 	Mode    ModeModel
 	Receive ReceiveModel
 	Send    SendModel
+	Text    TextModel
 	Relay   RelayModel
+	Nearby  NearbyModel
 	width   int
 	height  int
 }
@@ -20,6 +22,7 @@ func InitialModel() Model {
 	return Model{
 		Mode:    InitialModeModel(),
 		Send:    InitialSendModel(),
+		Text:    InitialTextModel(),
 		Receive: InitialReceiveModel(),
 		Relay:   NewRelayModel(),
 	}
@@ -57,6 +60,8 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				switch m.Mode.Choice {
 				case "Relay":
 					m.Relay.Stop()
+				case "Nearby":
+					m.Nearby.Stop()
 				}
 				m.Mode.Choice = ""
 				return m, nil
@@ -68,13 +73,25 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch m.Mode.Choice {
 		case "Send":
 			m.Send = InitialSendModel()
+		case "Text":
+			m.Text = InitialTextModel()
 		case "Receive":
 			m.Receive = InitialReceiveModel()
 		case "Relay":
 			m.Relay = NewRelayModel()
+		case "Nearby":
+			m.Nearby = NearbyModel{}
 		}
 		m.Mode.Choice = ""
 		return m, nil
+
+	case JoinNearbyMsg:
+		m.Nearby = NearbyModel{}
+		m.Mode.Choice = "Receive"
+		cmd := m.initReceive()
+		m.Receive.sessionInput.SetValue(msg.SessionID + "-")
+		m.Receive.sessionInput.CursorEnd()
+		return m, cmd
 	}
 
 	var cmd tea.Cmd
@@ -88,6 +105,10 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, cmd
 
+	case "Text":
+		m.Text, cmd = m.Text.Update(msg)
+		return m, cmd
+
 	case "Receive":
 		receiveModel, cmd := m.Receive.Update(msg)
 		var ok bool
@@ -101,6 +122,10 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.Relay, cmd = m.Relay.Update(msg)
 		return m, cmd
 
+	case "Nearby":
+		m.Nearby, cmd = m.Nearby.Update(msg)
+		return m, cmd
+
 	default:
 		m.Mode, cmd = m.Mode.Update(msg)
 		if m.Mode.Choice != "" {
@@ -115,13 +140,15 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					return m, cmd
 				}
 
+			case "Text":
+				m.Text = InitialTextModel()
+				m.Text, _ = m.Text.Update(tea.WindowSizeMsg{Width: m.width, Height: m.height})
+				if cmd := m.Text.Init(); cmd != nil {
+					return m, cmd
+				}
+
 			case "Receive":
-				m.Receive = InitialReceiveModel()
-				m.Receive.width = m.width
-				m.Receive.height = m.height
-				m.Receive.progress.Width = m.width - 20
-				m.Receive.sessionInput.Width = m.width - 20
-				if cmd := m.Receive.Init(); cmd != nil {
+				if cmd := m.initReceive(); cmd != nil {
 					return m, cmd
 				}
 
@@ -130,12 +157,29 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				if cmd := m.Relay.Init(); cmd != nil {
 					return m, cmd
 				}
+
+			case "Nearby":
+				m.Nearby = NewNearbyModel()
+				m.Nearby.width = m.width
+				m.Nearby.height = m.height
+				if cmd := m.Nearby.Init(); cmd != nil {
+					return m, cmd
+				}
 			}
 		}
 		return m, cmd
 	}
 }
 
+func (m *Model) initReceive() tea.Cmd {
+	m.Receive = InitialReceiveModel()
+	m.Receive.width = m.width
+	m.Receive.height = m.height
+	m.Receive.progress.Width = m.width - 20
+	m.Receive.sessionInput.Width = m.width - 20
+	return m.Receive.Init()
+}
+
 func (m Model) View() string {
 	var s strings.Builder
 	if Error != nil {
@@ -145,10 +189,14 @@ func (m Model) View() string {
 	switch m.Mode.Choice {
 	case "Send":
 		return m.Send.View()
+	case "Text":
+		return m.Text.View()
 	case "Receive":
 		return m.Receive.View()
 	case "Relay":
 		return m.Relay.View()
+	case "Nearby":
+		return m.Nearby.View()
 	default:
 		return m.Mode.View()
 	}
@@ -85,7 +85,9 @@ func (m ModeModel) View() string {
 func CreateModeList() list.Model {
 	items := []list.Item{
 		ModeItem{ModeName: "Send", ModeDesc: "Send a file to a receiver"},
+		ModeItem{ModeName: "Text", ModeDesc: "Send a text snippet or the clipboard"},
 		ModeItem{ModeName: "Receive", ModeDesc: "Receive a file from a sender"},
+		ModeItem{ModeName: "Nearby", ModeDesc: "Receive from a sender on this network"},
 		ModeItem{ModeName: "Relay", ModeDesc: "Start a relay server"},
 	}
 
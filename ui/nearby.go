@@ -0,0 +1,185 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"ft_0/server"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// nearbyExpiry is how long a sender stays listed after it last answered.
+const nearbyExpiry = 3 * time.Second
+
+type NearbyModel struct {
+	senders []nearbySender
+	cursor  int
+	found   <-chan server.Nearby
+	cancel  context.CancelFunc
+	err     error
+	width   int
+	height  int
+}
+
+type nearbySender struct {
+	server.Nearby
+	seen time.Time
+}
+
+type nearbyMsg struct {
+	nearby server.Nearby
+	ok     bool
+}
+
+type nearbyTickMsg time.Time
+
+// JoinNearbyMsg asks for the Receive screen, ready for the code of the
+// session a nearby sender serves.
+type JoinNearbyMsg struct {
+	SessionID string
+}
+
+func NewNearbyModel() NearbyModel {
+	ctx, cancel := context.WithCancel(context.Background())
+	found, err := server.Browse(ctx)
+	if err != nil {
+		cancel()
+		return NearbyModel{err: err}
+	}
+	return NearbyModel{found: found, cancel: cancel}
+}
+
+func (m NearbyModel) Init() tea.Cmd {
+	if m.found == nil {
+		return nil
+	}
+	return tea.Batch(listenForNearby(m.found), nearbyTick())
+}
+
+func listenForNearby(found <-chan server.Nearby) tea.Cmd {
+	return func() tea.Msg {
+		nearby, ok := <-found
+		return nearbyMsg{nearby: nearby, ok: ok}
+	}
+}
+
+func nearbyTick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+		return nearbyTickMsg(t)
+	})
+}
+
+func (m NearbyModel) Update(msg tea.Msg) (NearbyModel, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+		return m, nil
+
+	case nearbyMsg:
+		if !msg.ok {
+			return m, nil
+		}
+		m.seen(msg.nearby)
+		return m, listenForNearby(m.found)
+
+	case nearbyTickMsg:
+		if m.found == nil {
+			return m, nil
+		}
+		m.expire(time.Time(msg))
+		return m, nearbyTick()
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "q", "esc":
+			m.Stop()
+			return m, func() tea.Msg {
+				return ReturnToMenuMsg{}
+			}
+		case "up", "k":
+			m.cursor = max(m.cursor-1, 0)
+		case "down", "j":
+			m.cursor = min(m.cursor+1, max(len(m.senders)-1, 0))
+		case "enter":
+			if len(m.senders) == 0 {
+				return m, nil
+			}
+			sessionID := m.senders[m.cursor].SessionID
+			m.Stop()
+			return m, func() tea.Msg {
+				return JoinNearbyMsg{SessionID: sessionID}
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// seen adds a sender that answered or refreshes the one already listed.
+func (m *NearbyModel) seen(nearby server.Nearby) {
+	for i := range m.senders {
+		if m.senders[i].SessionID == nearby.SessionID {
+			m.senders[i] = nearbySender{Nearby: nearby, seen: time.Now()}
+			return
+		}
+	}
+	m.senders = append(m.senders, nearbySender{Nearby: nearby, seen: time.Now()})
+}
+
+// expire drops senders that stopped answering.
+func (m *NearbyModel) expire(now time.Time) {
+	senders := m.senders[:0]
+	for _, s := range m.senders {
+		if now.Sub(s.seen) < nearbyExpiry {
+			senders = append(senders, s)
+		}
+	}
+	m.senders = senders
+	m.cursor = min(m.cursor, max(len(m.senders)-1, 0))
+}
+
+func (m NearbyModel) View() string {
+	var s strings.Builder
+	textHighlight := lipgloss.NewStyle().Foreground(lipgloss.Color(Accent))
+	muted := lipgloss.NewStyle().Foreground(lipgloss.Color(Muted))
+
+	switch {
+	case m.err != nil:
+		s.WriteString(errorStyle.Render(fmt.Sprintf("Error: %v", m.err)))
+	case len(m.senders) == 0:
+		s.WriteString("Looking for senders on this network...")
+	default:
+		s.WriteString("Senders on this network:\n\n")
+		for i, sender := range m.senders {
+			host := sender.Host
+			if host == "" {
+				host = sender.Addrs[0]
+			}
+			line := fmt.Sprintf("%s — %s", host, sender.SessionID)
+			if i == m.cursor {
+				s.WriteString(textHighlight.Render("> "+line) + "\n")
+			} else {
+				s.WriteString("  " + line + "\n")
+			}
+		}
+		s.WriteString(muted.Render("\nYou still need the rest of the code from the sender"))
+	}
+
+	return AppFrame(
+		Container.Render(s.String()),
+		"j/↓: down • k/↑: up • enter: receive • q: back",
+		m.width,
+		m.height,
+	)
+}
+
+// Stop ends browsing for senders.
+func (m NearbyModel) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
@@ -1,11 +1,17 @@
 package ui
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"ft_0/server"
-	"net"
+	"os"
+	"slices"
+	"strings"
 
+	"github.com/atotto/clipboard"
+	"github.com/charmbracelet/bubbles/filepicker"
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/progress"
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
@@ -14,10 +20,19 @@ import (
 
 type ReceiveModel struct {
 	sessionInput  textinput.Model
-	sessionId     string
+	code          string
 	err           error
 	transferState TransferStatus
 	progressChan  chan server.ReceiveProgress
+	dirPicker     filepicker.Model
+	choosingDir   bool
+	dest          string
+	conflicts     server.Conflicts
+	asking        []int
+	request       *server.FileRequest
+	text          *bytes.Buffer
+	notice        string
+	limiter       *server.Limiter
 	cancelChan    chan struct{}
 	progress      progress.Model
 	width         int
@@ -26,16 +41,28 @@ type ReceiveModel struct {
 }
 
 type TransferStatus struct {
-	Progress float64
-	Speed    float64
-	State    server.TransferState
-	Error    error
+	Progress  float64
+	Speed     float64
+	WireSpeed float64
+	Streams   int
+	FileIndex int
+	FileName  string
+	Files     []server.FileOutcome
+	State     server.TransferState
+	Error     error
 }
 
 type transferMsg server.ReceiveProgress
 
+// requestMsg delivers the offer of the sender that answered a request.
+type requestMsg struct {
+	conn *server.ReceiverConn
+	meta server.FileMetadata
+	err  error
+}
+
 var (
-	conn       *net.Conn
+	conn       *server.ReceiverConn
 	metadata   server.FileMetadata
 	selected   string
 	confirmed  string
@@ -56,6 +83,8 @@ func InitialReceiveModel() ReceiveModel {
 			State: server.StateInitializing,
 		},
 		progress:   progress.New(progress.WithSolidFill(Accent)),
+		limiter:    server.NewLimiter(0),
+		conflicts:  server.Conflicts{Policy: server.LoadConfig().ConflictPolicy},
 		cancelChan: make(chan struct{}),
 	}
 }
@@ -83,28 +112,47 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.height = msg.Height
 		m.progress.Width = m.width - 20
 		m.sessionInput.Width = m.width - 40
+		m.dirPicker.Height = max(m.height-20, 5)
 		return m, nil
 
 	case transferMsg:
+		m.transferState.Files = msg.Files
 		if msg.Error != nil {
 			if sessionErr, ok := msg.Error.(server.SessionError); ok {
 				m.err = fmt.Errorf("%s", sessionErr.Message)
 			} else {
 				m.err = msg.Error
 			}
+			m.transferState.Error = m.err
 			m.transferState.State = server.StateError
 			return m, nil
 		}
-		m.transferState.Progress = float64(msg.BytesReceived) / float64(metadata.Size)
+		if msg.TotalBytes > 0 {
+			m.transferState.Progress = float64(msg.BytesReceived) / float64(msg.TotalBytes)
+		}
 		m.transferState.Speed = msg.Speed
+		m.transferState.WireSpeed = msg.WireSpeed
+		m.transferState.Streams = msg.Streams
 		m.transferState.Error = msg.Error
 		m.transferState.State = msg.State
+		m.transferState.FileIndex = msg.FileIndex
+		m.transferState.FileName = msg.FileName
 
 		if msg.State != server.StateCompleted && msg.State != server.StateError && msg.State != server.StateCancelled {
 			return m, listenForTransferProgress(m.progressChan)
 		}
 		return m, nil
 
+	case requestMsg:
+		if msg.err != nil {
+			m.err = msg.err
+			return m, nil
+		}
+		conn = msg.conn
+		metadata = msg.meta
+		m.code = m.request.Code
+		return m, nil
+
 	case tea.KeyMsg:
 		if msg.Type == tea.KeyCtrlC {
 			if m.cancelFunc != nil {
@@ -116,6 +164,10 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 
+		if m.transferState.State == server.StateReceiving && adjustLimit(m.limiter, msg.String()) {
+			return m, nil
+		}
+
 		if m.err != nil {
 			resetState()
 			return m, func() tea.Msg {
@@ -123,8 +175,54 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 
+		if m.request != nil && conn == nil {
+			return m, nil
+		}
+
+		if len(m.asking) > 0 {
+			return m.answerConflict(msg.String())
+		}
+
+		if m.choosingDir {
+			switch msg.Type {
+			case tea.KeyEnter:
+				return m.chooseDir(m.dirPicker.CurrentDirectory)
+			case tea.KeyTab:
+				m.conflicts.Policy = nextPolicy(m.conflicts.Policy)
+				return m, nil
+			}
+			m.dirPicker, cmd = m.dirPicker.Update(msg)
+			return m, cmd
+		}
+
+		if m.text != nil && m.transferState.State == server.StateCompleted {
+			switch msg.String() {
+			case "c":
+				if err := clipboard.WriteAll(m.text.String()); err != nil {
+					m.notice = errorStyle.Render(fmt.Sprintf("Could not copy to the clipboard: %v", err))
+				} else {
+					m.notice = "Copied to the clipboard"
+				}
+				return m, nil
+			case "s":
+				name, err := server.SaveText(metadata, downloadDir(), m.text.Bytes())
+				if err != nil {
+					m.notice = errorStyle.Render(err.Error())
+				} else {
+					m.notice = "Saved to " + name
+				}
+				return m, nil
+			}
+		}
+
 		if m.transferState.State == server.StateCompleted || m.transferState.State == server.StateCancelled || m.transferState.State == server.StateError {
-			err := server.LeaveSession(m.sessionId)
+			var err error
+			if conn != nil {
+				err = conn.Leave()
+			} else {
+				sessionID, _, _ := server.SplitCode(m.code)
+				err = server.LeaveSession(sessionID)
+			}
 			if err != nil {
 				m.err = err
 				return m, nil
@@ -135,16 +233,20 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 
+		if msg.Type == tea.KeyCtrlR && m.code == "" {
+			return m.startRequest()
+		}
+
 		if msg.Type == tea.KeyEnter {
-			if m.sessionId == "" {
-				m.sessionId = m.sessionInput.Value()
-				if m.sessionId != "" {
-					cn, err := server.StartReceiver(m.sessionId)
+			if m.code == "" {
+				m.code = m.sessionInput.Value()
+				if m.code != "" {
+					cn, err := server.StartReceiver(m.code)
 					if err != nil {
 						m.err = err
 						return m, nil
 					}
-					conn = &cn
+					conn = cn
 					meta, err := server.ReceiveMetadata(cn)
 					if err != nil {
 						m.err = err
@@ -162,76 +264,238 @@ func (m ReceiveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return ReturnToMenuMsg{}
 			}
 		}
-		if metadata != (server.FileMetadata{}) {
+		if len(metadata.Files) > 0 {
 			if msg.Type == tea.KeyEnter {
 				if selected == "n" || selected == "N" {
 					confirmed = "n"
 					if conn != nil {
-						(*conn).Write([]byte("rejected\n"))
-						(*conn).Close()
+						server.RejectTransfer(conn)
 					}
 					m.transferState.State = server.StateCancelled
 					return m, nil
 				} else if selected == "y" || selected == "Y" || selected == "" {
 					confirmed = "y"
-					m.progressChan = make(chan server.ReceiveProgress)
-					ctx, cancel := context.WithCancel(context.Background())
-					m.cancelFunc = cancel
-					server.ReceiveFile(*conn, metadata, m.progressChan, ctx)
-					return m, listenForTransferProgress(m.progressChan)
+					if server.IsText(metadata) {
+						return m.startText()
+					}
+					m.choosingDir = true
+					m.dirPicker = CreateDirPicker(downloadDir())
+					m.dirPicker.Height = max(m.height-20, 5)
+					return m, m.dirPicker.Init()
 				}
 			}
 			selected = msg.String()
 			return m, nil
 		}
 		if msg.Type == tea.KeyEnter {
-			m.sessionId = m.sessionInput.Value()
+			m.code = m.sessionInput.Value()
 		}
 	}
 
+	if m.choosingDir {
+		m.dirPicker, cmd = m.dirPicker.Update(msg)
+		return m, cmd
+	}
+
 	m.sessionInput, cmd = m.sessionInput.Update(msg)
 	return m, cmd
 }
 
+func (m ReceiveModel) chooseDir(dir string) (tea.Model, tea.Cmd) {
+	if _, _, ok := server.CheckSpace(metadata, dir); !ok {
+		return m, nil
+	}
+	m.choosingDir = false
+	m.dest = dir
+	if m.conflicts.Policy == "" {
+		m.conflicts.Policy = server.ConflictRename
+	}
+
+	config := server.LoadConfig()
+	config.DownloadDir = dir
+	config.ConflictPolicy = m.conflicts.Policy
+	server.SaveConfig(config)
+
+	if m.conflicts.Policy == server.ConflictAsk {
+		m.conflicts.Files = make(map[int]server.ConflictPolicy)
+		m.asking = server.FindConflicts(metadata, dir)
+		if len(m.asking) > 0 {
+			return m, nil
+		}
+	}
+	return m.startReceive()
+}
+
+func (m ReceiveModel) answerConflict(key string) (tea.Model, tea.Cmd) {
+	answers := map[string]server.ConflictPolicy{
+		"r": server.ConflictRename,
+		"o": server.ConflictOverwrite,
+		"s": server.ConflictSkip,
+		"u": server.ConflictResume,
+	}
+
+	policy, ok := answers[strings.ToLower(key)]
+	if !ok {
+		return m, nil
+	}
+	if key != strings.ToLower(key) {
+		for _, index := range m.asking {
+			m.conflicts.Files[index] = policy
+		}
+		m.asking = nil
+	} else {
+		m.conflicts.Files[m.asking[0]] = policy
+		m.asking = m.asking[1:]
+	}
+
+	if len(m.asking) > 0 {
+		return m, nil
+	}
+	return m.startReceive()
+}
+
+func (m ReceiveModel) startReceive() (tea.Model, tea.Cmd) {
+	m.progressChan = make(chan server.ReceiveProgress)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancelFunc = cancel
+	server.ReceiveFile(conn, metadata, m.dest, m.conflicts, m.limiter, m.progressChan, ctx)
+	return m, listenForTransferProgress(m.progressChan)
+}
+
+func (m ReceiveModel) startRequest() (tea.Model, tea.Cmd) {
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := server.CreateRequest(ctx)
+	if err != nil {
+		cancel()
+		m.err = err
+		return m, nil
+	}
+	m.request = request
+	m.cancelFunc = cancel
+
+	return m, func() tea.Msg {
+		cn, err := request.Wait(ctx)
+		if err != nil {
+			return requestMsg{err: err}
+		}
+		meta, err := server.ReceiveMetadata(cn)
+		if err != nil {
+			cn.Close()
+			return requestMsg{err: err}
+		}
+		return requestMsg{conn: cn, meta: meta}
+	}
+}
+
+func (m ReceiveModel) startText() (tea.Model, tea.Cmd) {
+	m.text = &bytes.Buffer{}
+	m.progressChan = make(chan server.ReceiveProgress)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancelFunc = cancel
+	server.ReceiveStream(conn, metadata, m.text, m.limiter, m.progressChan, ctx)
+	return m, listenForTransferProgress(m.progressChan)
+}
+
+func nextPolicy(policy server.ConflictPolicy) server.ConflictPolicy {
+	index := slices.Index(server.ConflictPolicies, policy)
+	return server.ConflictPolicies[(index+1)%len(server.ConflictPolicies)]
+}
+
+func policyView(policy server.ConflictPolicy) string {
+	if policy == "" {
+		policy = server.ConflictRename
+	}
+	return map[server.ConflictPolicy]string{
+		server.ConflictRename:    "rename the new file",
+		server.ConflictOverwrite: "overwrite it",
+		server.ConflictSkip:      "skip it",
+		server.ConflictResume:    "resume if it is a partial copy",
+		server.ConflictAsk:       "ask for each file",
+	}[policy]
+}
+
+func downloadDir() string {
+	if dir := server.LoadConfig().DownloadDir; dir != "" {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
 func createView(m *ReceiveModel) string {
 	textHighlight := lipgloss.NewStyle().Foreground(lipgloss.Color(Accent))
-	metaString := fmt.Sprintf(
-		("Filename : %s\n" +
-			"Size     : %s\n" +
-			"From     : %s\n\n"),
-		textHighlight.Render(metadata.Name),
-		textHighlight.Render(fmt.Sprintf("%d bytes", metadata.Size)),
-		textHighlight.Render(metadata.SenderIP),
-	)
+	metaString := metadataView(textHighlight)
+
+	checksumString := ""
+	if len(m.transferState.Files) == 1 && m.transferState.Files[0].Checksum != "" {
+		checksumString = fmt.Sprintf("SHA-256  : %s\n\n", textHighlight.Render(m.transferState.Files[0].Checksum))
+	} else {
+		checksumString = fileOutcomes(m.transferState.Files)
+	}
+
+	if m.choosingDir {
+		return metaString + fmt.Sprintf(
+			"Save to: %s\nIf a file exists: %s\n%s\n%s\n",
+			textHighlight.Render(m.dirPicker.CurrentDirectory),
+			textHighlight.Render(policyView(m.conflicts.Policy)),
+			spaceWarning(m.dirPicker.CurrentDirectory),
+			m.dirPicker.View(),
+		)
+	}
+
+	if len(m.asking) > 0 {
+		return metaString + fmt.Sprintf(
+			"%s already exists in %s (%d left)\n\n"+
+				"[r]ename  [o]verwrite  [s]kip  res[u]me\n",
+			textHighlight.Render(metadata.Files[m.asking[0]].Name),
+			textHighlight.Render(m.dest),
+			len(m.asking),
+		)
+	}
 
 	switch m.transferState.State {
 	case server.StateError:
-		return fmt.Sprintf("Error: %v\n\nPress any key to continue\n", m.transferState.Error)
+		return checksumString + fmt.Sprintf("Error: %v\n\nPress any key to continue\n", m.transferState.Error)
 
 	case server.StateCancelled:
 		return metaString + "Transfer cancelled\n\nPress any key to continue\n"
 
 	case server.StateCompleted:
-		return metaString + "File received\n\nPress any key to continue\n"
+		if m.text != nil {
+			return textView(m.text.String(), max(m.height-16, 3)) + m.notice + "\n\nPress c to copy, s to save or any other key to continue\n"
+		}
+		if len(m.transferState.Files) == 1 && m.transferState.Files[0].Skipped {
+			return metaString + "File skipped - it already exists\n\nPress any key to continue\n"
+		}
+		if len(metadata.Files) > 1 {
+			return metaString + checksumString + "Files received and verified\n\nPress any key to continue\n"
+		}
+		return metaString + checksumString + "File received and verified\n\nPress any key to continue\n"
 
 	case server.StateReceiving:
 		progressBar := m.progress.ViewAs(m.transferState.Progress)
+		if len(metadata.Files) > 1 && m.transferState.FileName != "" {
+			metaString += fmt.Sprintf("Receiving %s (%d of %d)\n", m.transferState.FileName, m.transferState.FileIndex+1, len(metadata.Files))
+		}
 		return metaString + fmt.Sprintf(
-			"%s\n(%.2f MB/s)\n",
+			"%s\n(%s)\n%s\n",
 			progressBar,
-			m.transferState.Speed,
+			speedView(m.transferState.Speed, m.transferState.WireSpeed, m.transferState.Streams),
+			limitView(m.limiter),
 		)
 	}
 
-	if m.sessionId != "" {
-		if metadata == (server.FileMetadata{}) || conn == nil {
-			cn, err := server.StartReceiver(m.sessionId)
+	if m.code != "" {
+		if len(metadata.Files) == 0 || conn == nil {
+			cn, err := server.StartReceiver(m.code)
 			if err != nil {
 				m.err = err
 				return errorStyle.Render(fmt.Sprintf("Error: %v", err)) + "\n\nPress any key to continue"
 			}
-			conn = &cn
-			if metadata == (server.FileMetadata{}) {
+			conn = cn
+			if len(metadata.Files) == 0 {
 				meta, err := server.ReceiveMetadata(cn)
 				if err != nil {
 					return fmt.Sprintf("Error: %v", err)
@@ -240,38 +504,151 @@ func createView(m *ReceiveModel) string {
 			}
 		}
 
-		metaString := fmt.Sprintf(
-			("Filename : %s\n" +
-				"Size     : %s\n" +
-				"From     : %s\n\n"),
-			textHighlight.Render(metadata.Name),
-			textHighlight.Render(fmt.Sprintf("%d bytes", metadata.Size)),
-			textHighlight.Render(metadata.SenderIP),
-		)
+		metaString := metadataView(textHighlight)
 		if confirmed == "" {
-			return metaString + fmt.Sprintf(
-				"Accept file? (Y/n): %s\n",
+			prompt := "Accept file? (Y/n): %s\n"
+			if len(metadata.Files) > 1 {
+				prompt = "Accept files? (Y/n): %s\n"
+			}
+			if server.IsText(metadata) {
+				return metaString + fmt.Sprintf("Accept text? (Y/n): %s\n", textHighlight.Render(selected))
+			}
+			return metaString + spaceWarning(downloadDir()) + fmt.Sprintf(
+				prompt,
 				textHighlight.Render(selected),
 			)
 		}
 	}
+	if m.err != nil && conn == nil {
+		return errorStyle.Render(fmt.Sprintf("Error: %v", m.err)) + "\n\nPress any key to continue"
+	}
+	if m.request != nil {
+		return fmt.Sprintf(
+			"Your request code is: %s\n"+
+				"Share it with the sender - they pick files in Send mode and press a to enter it\n\n"+
+				"Waiting for the sender...\n",
+			textHighlight.Render(m.request.Code),
+		)
+	}
 	inputStyle := lipgloss.NewStyle().Foreground(lipgloss.Color(Accent))
 	return fmt.Sprintf(
-		"Input sender's Session ID\n\n%s\n",
+		"Input the code shared by the sender\n\n%s\n",
 		inputStyle.Render(m.sessionInput.View()),
 	)
 }
 
+func spaceWarning(dir string) string {
+	needed, free, ok := server.CheckSpace(metadata, dir)
+	if ok {
+		return ""
+	}
+	return errorStyle.Render(fmt.Sprintf(
+		"Not enough space in %s: %d bytes needed, %d bytes free", dir, needed, free,
+	)) + "\n\n"
+}
+
+func textView(text string, height int) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > height {
+		lines = append(lines[:height-1], fmt.Sprintf("... %d more lines", len(lines)-height+1))
+	}
+	return lipgloss.NewStyle().
+		Border(lipgloss.NormalBorder()).
+		BorderForeground(lipgloss.Color(Muted)).
+		Padding(0, 1).
+		Render(strings.Join(lines, "\n")) + "\n\n"
+}
+
+func fromView() string {
+	if conn == nil {
+		return metadata.SenderIP
+	}
+	switch conn.Transport() {
+	case "quic":
+		return metadata.SenderIP + " (QUIC)"
+	case "webrtc":
+		return metadata.SenderIP + " (WebRTC)"
+	case "udp":
+		return metadata.SenderIP + " (hole punched)"
+	}
+	return metadata.SenderIP
+}
+
+func metadataView(textHighlight lipgloss.Style) string {
+	if server.IsText(metadata) {
+		return fmt.Sprintf(
+			("Text     : %s\n" +
+				"From     : %s\n\n"),
+			textHighlight.Render(fmt.Sprintf("%d bytes", metadata.Size)),
+			textHighlight.Render(fromView()),
+		)
+	}
+	if len(metadata.Files) == 1 {
+		return fmt.Sprintf(
+			("Filename : %s\n" +
+				"Size     : %s\n" +
+				"From     : %s\n\n"),
+			textHighlight.Render(metadata.Name),
+			textHighlight.Render(fmt.Sprintf("%d bytes", metadata.Size)),
+			textHighlight.Render(fromView()),
+		)
+	}
+
+	var s strings.Builder
+	s.WriteString(fmt.Sprintf(
+		("Files    : %s\n" +
+			"Size     : %s\n" +
+			"From     : %s\n\n"),
+		textHighlight.Render(metadata.Name),
+		textHighlight.Render(fmt.Sprintf("%d bytes", metadata.Size)),
+		textHighlight.Render(fromView()),
+	))
+	for _, f := range metadata.Files[:min(len(metadata.Files), maxListedFiles)] {
+		if f.Dir {
+			s.WriteString(fmt.Sprintf("  %s/\n", f.Name))
+		} else {
+			s.WriteString(fmt.Sprintf("  %s (%d bytes)\n", f.Name, f.Size))
+		}
+	}
+	if len(metadata.Files) > maxListedFiles {
+		s.WriteString(fmt.Sprintf("  ... and %d more\n", len(metadata.Files)-maxListedFiles))
+	}
+	s.WriteString("\n")
+	return s.String()
+}
+
 func (m ReceiveModel) View() string {
 	m.sessionInput.Focus()
-	return AppFrame(Container.Render(createView(&m)), "ctrl + c: quit", m.width, m.height)
+	help := "ctrl + c: quit"
+	if m.code == "" && m.request == nil {
+		help = "enter: join • ctrl + r: request files instead • ctrl + c: quit"
+	}
+	if m.choosingDir {
+		help = "j/↓: down • k/↑: up • l/→: open • h/←: back • tab: if a file exists • enter: save here • ctrl + c: quit"
+	} else if len(m.asking) > 0 {
+		help = "r/o/s/u: this file • R/O/S/U: all remaining files • ctrl + c: quit"
+	} else if m.transferState.State == server.StateReceiving {
+		help = "-/+: transfer limit • [/]: global limit • ctrl + c: quit"
+	} else if m.text != nil && m.transferState.State == server.StateCompleted {
+		help = "c: copy to clipboard • s: save to file • ctrl + c: quit"
+	}
+	return AppFrame(Container.Render(createView(&m)), help, m.width, m.height)
+}
+
+func CreateDirPicker(dir string) filepicker.Model {
+	fp := CreateFilepicker()
+	fp.CurrentDirectory = dir
+	fp.FileAllowed = false
+	fp.KeyMap.Open = key.NewBinding(key.WithKeys("l", "right", " "), key.WithHelp("l", "open"))
+	fp.KeyMap.Select = key.NewBinding(key.WithDisabled())
+	return fp
 }
 
 func CreateSessionInput() textinput.Model {
 	input := textinput.New()
 	input.Focus()
-	input.Placeholder = "Session ID"
-	input.CharLimit = 6
+	input.Placeholder = "Code"
+	input.CharLimit = 19
 	input.Width = 10
 
 	return input
@@ -5,28 +5,66 @@ import (
 	"fmt"
 	"ft_0/server"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/filepicker"
+	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/progress"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
 
 type senderMsg server.SendProgress
 
+const maxListedFiles = 10
+
+var (
+	receiverLimits  = []int{0, 2, 3, 5, 10}
+	sessionTimeouts = []time.Duration{0, 5 * time.Minute, 15 * time.Minute, time.Hour}
+)
+
+type receiverRow struct {
+	addr       string
+	state      server.TransferState
+	bytesSent  int64
+	totalBytes int64
+	speed      float64
+	err        error
+}
+
 type SendModel struct {
 	filepicker    filepicker.Model
-	selectedFile  string
+	selectedFiles []string
+	text          string
+	multi         bool
+	maxReceivers  int
+	timeout       time.Duration
+	receivers     []receiverRow
+	requestInput  textinput.Model
+	answering     bool
+	request       string
+	ready         bool
 	progress      progress.Model
 	quitting      bool
 	err           error
 	transferState server.TransferState
 	sessionID     string
+	code          string
 	speed         float64
+	wireSpeed     float64
+	streams       int
 	bytesSent     int64
 	totalBytes    int64
+	fileIndex     int
+	fileCount     int
+	fileName      string
+	files         []server.FileOutcome
 	progressChan  chan server.SendProgress
+	limiter       *server.Limiter
 	cancel        context.CancelFunc
 	width         int
 	height        int
@@ -37,6 +75,7 @@ func InitialSendModel() SendModel {
 		filepicker:    CreateFilepicker(),
 		progress:      progress.New(progress.WithSolidFill(Accent)),
 		transferState: server.StateInitializing,
+		limiter:       server.NewLimiter(0),
 	}
 }
 
@@ -63,6 +102,21 @@ func (m SendModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.progress.Width = m.width - 20
 
 	case tea.KeyMsg:
+		if m.answering {
+			switch msg.Type {
+			case tea.KeyEnter:
+				m.request = strings.TrimSpace(m.requestInput.Value())
+				m.multi = m.multi && m.request == ""
+				m.answering = false
+			case tea.KeyEsc, tea.KeyCtrlC:
+				m.answering = false
+			default:
+				var cmd tea.Cmd
+				m.requestInput, cmd = m.requestInput.Update(msg)
+				return m, cmd
+			}
+			return m, nil
+		}
 		if msg.Type == tea.KeyEnter && (m.transferState == server.StateCompleted ||
 			m.transferState == server.StateError ||
 			m.transferState == server.StateCancelled) {
@@ -79,22 +133,73 @@ func (m SendModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return ReturnToMenuMsg{}
 			}
 		}
+		if m.ready && adjustLimit(m.limiter, msg.String()) {
+			return m, nil
+		}
+		if !m.ready && m.text == "" {
+			switch msg.String() {
+			case "a":
+				m.answering = true
+				m.requestInput = CreateSessionInput()
+				m.requestInput.SetValue(m.request)
+				return m, textinput.Blink
+			case "m":
+				m.multi = !m.multi
+				if m.multi {
+					m.request = ""
+				}
+				return m, nil
+			case "r":
+				if m.multi {
+					m.maxReceivers = receiverLimits[(slices.Index(receiverLimits, m.maxReceivers)+1)%len(receiverLimits)]
+				}
+				return m, nil
+			case "t":
+				if m.multi {
+					m.timeout = sessionTimeouts[(slices.Index(sessionTimeouts, m.timeout)+1)%len(sessionTimeouts)]
+				}
+				return m, nil
+			}
+		}
 
 	case senderMsg:
+		if msg.Receiver > 0 {
+			for len(m.receivers) < msg.Receiver {
+				m.receivers = append(m.receivers, receiverRow{})
+			}
+			row := &m.receivers[msg.Receiver-1]
+			row.addr = msg.ReceiverAddr
+			row.state = msg.State
+			row.speed = msg.Speed
+			row.err = msg.Error
+			if msg.TotalBytes > 0 || msg.BytesSent > 0 {
+				row.bytesSent = msg.BytesSent
+				row.totalBytes = msg.TotalBytes
+			}
+			return m, listenForSenderProgress(m.progressChan)
+		}
 		if msg.Error != nil {
 			if sessionErr, ok := msg.Error.(server.SessionError); ok {
 				m.err = fmt.Errorf("%s", sessionErr.Message)
 			} else {
 				m.err = msg.Error
 			}
+			m.files = msg.Files
 			m.transferState = server.StateError
 			return m, nil
 		}
 		m.transferState = msg.State
 		m.sessionID = msg.SessionID
+		m.code = msg.Code
 		m.speed = msg.Speed
+		m.wireSpeed = msg.WireSpeed
+		m.streams = msg.Streams
 		m.bytesSent = msg.BytesSent
 		m.totalBytes = msg.TotalBytes
+		m.fileIndex = msg.FileIndex
+		m.fileCount = msg.FileCount
+		m.fileName = msg.FileName
+		m.files = msg.Files
 
 		if msg.State != server.StateCompleted && msg.State != server.StateError && msg.State != server.StateCancelled {
 			return m, listenForSenderProgress(m.progressChan)
@@ -102,21 +207,47 @@ func (m SendModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, nil
 	}
 
-	if m.selectedFile != "" && m.progressChan == nil {
+	if m.ready && m.progressChan == nil {
 		progressChan := make(chan server.SendProgress)
 		m.progressChan = progressChan
 
 		ctx, cancel := context.WithCancel(context.Background())
 		m.cancel = cancel
-		server.StartSender(m.selectedFile, progressChan, ctx)
+		if m.text != "" {
+			server.StartTextSender(m.text, m.limiter, progressChan, ctx)
+		} else if m.request != "" {
+			server.StartRequestSender(m.request, m.selectedFiles, m.limiter, progressChan, ctx)
+		} else if m.multi {
+			opts := server.MultiOptions{MaxReceivers: m.maxReceivers, Timeout: m.timeout}
+			server.StartMultiSender(m.selectedFiles, opts, m.limiter, progressChan, ctx)
+		} else {
+			server.StartSender(m.selectedFiles, m.limiter, progressChan, ctx)
+		}
 		return m, listenForSenderProgress(progressChan)
 	}
 
 	var cmd tea.Cmd
+	if m.answering {
+		m.requestInput, cmd = m.requestInput.Update(msg)
+		return m, cmd
+	}
 	m.filepicker, cmd = m.filepicker.Update(msg)
 
 	if didSelect, path := m.filepicker.DidSelectFile(msg); didSelect {
-		m.selectedFile = path
+		index := slices.Index(m.selectedFiles, path)
+		if keyMsg, ok := msg.(tea.KeyMsg); ok && keyMsg.Type == tea.KeySpace {
+			if index >= 0 {
+				m.selectedFiles = slices.Delete(m.selectedFiles, index, index+1)
+			} else {
+				m.selectedFiles = append(m.selectedFiles, path)
+			}
+			return m, cmd
+		}
+
+		if index < 0 {
+			m.selectedFiles = append(m.selectedFiles, path)
+		}
+		m.ready = true
 	}
 
 	return m, cmd
@@ -133,37 +264,98 @@ func (m SendModel) View() string {
 
 	if m.err != nil {
 		s.WriteString(m.filepicker.Styles.DisabledFile.Render(m.err.Error()))
-	} else if m.selectedFile == "" {
-		help = "j/↓: up • k/↑: down • l/→: open • h/←: back • q: quit"
-		s.WriteString("Pick a file")
+	} else if m.answering {
+		help = "enter: confirm • esc: back"
+		s.WriteString("Input the request code shared by the receiver\n\n")
+		s.WriteString(emphasis.Render(m.requestInput.View()) + "\n")
+	} else if !m.ready {
+		help = "j/↓: up • k/↑: down • l/→: open • h/←: back • space: add to batch • enter: send file or folder • m: several receivers • a: answer a request • q: quit"
+		if m.multi {
+			help = "j/↓: up • k/↑: down • l/→: open • h/←: back • space: add to batch • enter: send file or folder • m: one receiver • r: receiver limit • t: time limit • q: quit"
+		}
+		if len(m.selectedFiles) == 0 {
+			s.WriteString("Pick a file or folder")
+		} else {
+			s.WriteString(fmt.Sprintf("Pick more files or folders (%d selected)", len(m.selectedFiles)))
+			for _, path := range m.selectedFiles {
+				s.WriteString("\n  " + emphasis.Render(filepath.Base(path)))
+			}
+		}
+		if m.multi {
+			s.WriteString("\nReceivers: " + emphasis.Render(multiView(m.maxReceivers, m.timeout)))
+		}
+		if m.request != "" {
+			s.WriteString("\nAnswering request: " + emphasis.Render(m.request))
+		}
 		s.WriteString("\n\n" + m.filepicker.View())
 	} else {
 		s.Reset()
-		s.WriteString(emphasis.Render(m.selectedFile))
-		s.WriteString("\n\n")
-		help = "q: quit"
+		for _, path := range m.selectedFiles {
+			s.WriteString(emphasis.Render(filepath.Base(path)) + "\n")
+		}
+		if m.text != "" {
+			s.WriteString(emphasis.Render(fmt.Sprintf("Text snippet (%d bytes)", len(m.text))) + "\n")
+		}
+		s.WriteString("\n")
+		help = "-/+: transfer limit • [/]: global limit • q: quit"
 		switch m.transferState {
 		case server.StateInitializing:
 			s.WriteString("Press any key to initialize transfer\n")
 
 		case server.StateWaitingForReceiver:
-			s.WriteString(fmt.Sprintf("Your session ID is: %s\n", emphasis.Render(m.sessionID)))
-			s.WriteString("Share this ID with the receiver to start the transfer\n\n")
-			s.WriteString("Waiting for receiver to join...\n")
+			if m.request != "" {
+				s.WriteString(fmt.Sprintf("Connected to request %s\n", emphasis.Render(m.request)))
+				s.WriteString("Waiting for the receiver to accept...\n")
+				s.WriteString("\n" + limitView(m.limiter) + "\n")
+				break
+			}
+			if m.multi {
+				s.WriteString(fmt.Sprintf("Your code is: %s\n", emphasis.Render(m.code)))
+				s.WriteString("Share this code with every receiver (" + multiView(m.maxReceivers, m.timeout) + ")\n\n")
+				if len(m.receivers) == 0 {
+					s.WriteString("Waiting for receivers to join...\n")
+				}
+				s.WriteString(m.receiversView())
+				s.WriteString("\n" + limitView(m.limiter) + "\n")
+				break
+			}
+			s.WriteString(fmt.Sprintf("Your code is: %s\n", emphasis.Render(m.code)))
+			s.WriteString("Share this code with the receiver to start the transfer\n\n")
+			if m.bytesSent > 0 {
+				s.WriteString(fmt.Sprintf("Connection lost after %d of %d bytes\n", m.bytesSent, m.totalBytes))
+				s.WriteString("Waiting for receiver to rejoin and resume...\n")
+			} else {
+				s.WriteString("Waiting for receiver to join...\n")
+			}
+			s.WriteString("\n" + limitView(m.limiter) + "\n")
 
 		case server.StateTransferring:
-			progress := float64(m.bytesSent) / float64(m.totalBytes)
+			progress := 1.0
+			if m.totalBytes > 0 {
+				progress = float64(m.bytesSent) / float64(m.totalBytes)
+			}
 			progressBar := m.progress.ViewAs(progress)
+			if m.fileCount > 1 && m.fileName != "" {
+				s.WriteString(fmt.Sprintf("Sending %s (%d of %d)\n", m.fileName, m.fileIndex+1, m.fileCount))
+			}
 			s.WriteString(fmt.Sprintf("%s\n", progressBar))
-			s.WriteString(fmt.Sprintf("%.2f MB/s\n", m.speed))
+			s.WriteString(speedView(m.speed, m.wireSpeed, m.streams) + "\n")
+			s.WriteString(limitView(m.limiter) + "\n")
 
 		case server.StateCompleted:
+			if m.multi {
+				s.WriteString(m.receiversView())
+				s.WriteString(fmt.Sprintf("\nSession closed after %d receivers\n\nPress enter to continue", len(m.receivers)))
+				break
+			}
+			s.WriteString(fileOutcomes(m.files))
 			s.WriteString("Transfer completed successfully\n\nPress enter to continue")
 
 		case server.StateCancelled:
 			s.WriteString("Transfer cancelled by user\n\nPress enter to continue")
 
 		case server.StateError:
+			s.WriteString(fileOutcomes(m.files))
 			s.WriteString(fmt.Sprintf("Error: %v\n\nPress any key to continue", m.err))
 		}
 	}
@@ -171,6 +363,44 @@ func (m SendModel) View() string {
 	return AppFrame(Container.Render(s.String()), help, m.width, m.height)
 }
 
+func (m SendModel) receiversView() string {
+	var s strings.Builder
+	bar := m.progress
+	bar.Width = max(min(m.width-60, 40), 10)
+	for i, row := range m.receivers {
+		label := fmt.Sprintf("%2d. %-22s ", i+1, row.addr)
+		switch {
+		case row.err != nil:
+			message := row.err.Error()
+			if sessionErr, ok := row.err.(server.SessionError); ok {
+				message = sessionErr.Message
+			}
+			s.WriteString(label + errorStyle.Render("✗ "+message) + "\n")
+		case row.state == server.StateCompleted:
+			s.WriteString(label + "✓ done\n")
+		case row.state == server.StateCancelled:
+			s.WriteString(label + "cancelled\n")
+		case row.totalBytes > 0:
+			progress := float64(row.bytesSent) / float64(row.totalBytes)
+			s.WriteString(label + bar.ViewAs(progress) + fmt.Sprintf(" %.2f MB/s\n", row.speed))
+		default:
+			s.WriteString(label + "connecting...\n")
+		}
+	}
+	return s.String()
+}
+
+func multiView(maxReceivers int, timeout time.Duration) string {
+	limit := "any number of receivers"
+	if maxReceivers > 0 {
+		limit = fmt.Sprintf("up to %d receivers", maxReceivers)
+	}
+	if timeout > 0 {
+		limit += fmt.Sprintf(" for %s", timeout)
+	}
+	return limit
+}
+
 func CreateFilepicker() filepicker.Model {
 	fp := filepicker.New()
 	fp.CurrentDirectory, _ = os.Getwd()
@@ -178,7 +408,9 @@ func CreateFilepicker() filepicker.Model {
 	fp.ShowHidden = true
 	fp.ShowPermissions = true
 	fp.FileAllowed = true
-	fp.DirAllowed = false
+	fp.DirAllowed = true
+	fp.KeyMap.Open = key.NewBinding(key.WithKeys("l", "right", "enter", " "), key.WithHelp("l", "open"))
+	fp.KeyMap.Select = key.NewBinding(key.WithKeys("enter", " "), key.WithHelp("enter", "select"))
 
 	fp.Styles = filepicker.Styles{
 		Cursor:         lipgloss.NewStyle().Foreground(lipgloss.Color(Accent)),
@@ -193,3 +425,106 @@ func CreateFilepicker() filepicker.Model {
 
 	return fp
 }
+
+func speedView(speed, wireSpeed float64, streams int) string {
+	view := fmt.Sprintf("%.2f MB/s", speed)
+	if wireSpeed > 0 && wireSpeed < speed*0.95 {
+		view = fmt.Sprintf("%.2f MB/s (%.2f MB/s on the wire)", speed, wireSpeed)
+	}
+	if streams > 1 {
+		view += fmt.Sprintf(" over %d streams", streams)
+	}
+	return view
+}
+
+var rateSteps = []int64{256 << 10, 512 << 10, 1 << 20, 2 << 20, 5 << 20, 10 << 20, 25 << 20, 50 << 20, 100 << 20}
+
+func adjustLimit(limiter *server.Limiter, key string) bool {
+	switch key {
+	case "-":
+		limiter.SetRate(stepRate(limiter.Rate(), false))
+	case "+", "=":
+		limiter.SetRate(stepRate(limiter.Rate(), true))
+	case "[":
+		server.SetGlobalRateLimit(stepRate(server.GlobalRateLimit(), false))
+	case "]":
+		server.SetGlobalRateLimit(stepRate(server.GlobalRateLimit(), true))
+	default:
+		return false
+	}
+	return true
+}
+
+func stepRate(rate int64, up bool) int64 {
+	if up {
+		if rate <= 0 {
+			return 0
+		}
+		for _, step := range rateSteps {
+			if step > rate {
+				return step
+			}
+		}
+		return 0
+	}
+
+	if rate <= 0 {
+		return rateSteps[len(rateSteps)-1]
+	}
+	for i := len(rateSteps) - 1; i >= 0; i-- {
+		if rateSteps[i] < rate {
+			return rateSteps[i]
+		}
+	}
+	return rateSteps[0]
+}
+
+func rateView(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%.2f MB/s", float64(rate)/1024/1024)
+}
+
+func limitView(limiter *server.Limiter) string {
+	return fmt.Sprintf("Limit: %s (global: %s)", rateView(limiter.Rate()), rateView(server.GlobalRateLimit()))
+}
+
+func fileOutcomes(files []server.FileOutcome) string {
+	if len(files) < 2 {
+		return ""
+	}
+
+	var s strings.Builder
+	succeeded, skipped := 0, 0
+	for _, f := range files {
+		if f.Skipped {
+			skipped++
+			if len(files) <= maxListedFiles {
+				s.WriteString("- " + f.Name + " (skipped, already exists)\n")
+			}
+			continue
+		}
+		if f.Error != nil {
+			message := f.Error.Error()
+			if sessionErr, ok := f.Error.(server.SessionError); ok {
+				message = sessionErr.Message
+			}
+			s.WriteString(errorStyle.Render("✗ "+f.Name) + " " + message + "\n")
+			continue
+		}
+
+		succeeded++
+		if len(files) <= maxListedFiles {
+			s.WriteString("✓ " + f.Name + "\n")
+		}
+	}
+	if len(files) > maxListedFiles {
+		s.WriteString(fmt.Sprintf("✓ %d of %d items\n", succeeded, len(files)))
+		if skipped > 0 {
+			s.WriteString(fmt.Sprintf("- %d skipped, already exist\n", skipped))
+		}
+	}
+	s.WriteString("\n")
+	return s.String()
+}
@@ -0,0 +1,109 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atotto/clipboard"
+	"github.com/charmbracelet/bubbles/textarea"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+type TextModel struct {
+	input   textarea.Model
+	send    SendModel
+	sending bool
+	err     error
+	width   int
+	height  int
+}
+
+func InitialTextModel() TextModel {
+	return TextModel{
+		input: CreateTextInput(),
+		send:  InitialSendModel(),
+	}
+}
+
+func (m TextModel) Init() tea.Cmd {
+	return textarea.Blink
+}
+
+func (m TextModel) Update(msg tea.Msg) (TextModel, tea.Cmd) {
+	if m.sending {
+		sendModel, cmd := m.send.Update(msg)
+		var ok bool
+		m.send, ok = sendModel.(SendModel)
+		if !ok {
+			panic("could not perform send model type assertion")
+		}
+		return m, cmd
+	}
+
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+		m.input.SetWidth(m.width - 8)
+		m.input.SetHeight(max(m.height-14, 3))
+
+	case tea.KeyMsg:
+		m.err = nil
+		switch msg.String() {
+		case "ctrl+s":
+			if strings.TrimSpace(m.input.Value()) == "" {
+				m.err = fmt.Errorf("type or paste some text first")
+				return m, nil
+			}
+			m.sending = true
+			m.send.text = m.input.Value()
+			m.send.ready = true
+			m.send.width = m.width
+			m.send.height = m.height
+			m.send.progress.Width = m.width - 20
+			return m.Update(msg)
+
+		case "ctrl+l":
+			text, err := clipboard.ReadAll()
+			if err != nil {
+				m.err = fmt.Errorf("could not read the clipboard: %v", err)
+				return m, nil
+			}
+			m.input.SetValue(text)
+			return m, nil
+		}
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+func (m TextModel) View() string {
+	if m.sending {
+		return m.send.View()
+	}
+
+	var s strings.Builder
+	s.WriteString("Type or paste the text to send\n\n")
+	s.WriteString(m.input.View() + "\n\n")
+	s.WriteString(lipgloss.NewStyle().Foreground(lipgloss.Color(Muted)).Render(
+		fmt.Sprintf("%d bytes", len(m.input.Value()))) + "\n")
+	if m.err != nil {
+		s.WriteString("\n" + errorStyle.Render(m.err.Error()) + "\n")
+	}
+
+	help := "ctrl + s: send • ctrl + v: paste • ctrl + l: use clipboard • ctrl + c: back"
+	return AppFrame(Container.Render(s.String()), help, m.width, m.height)
+}
+
+func CreateTextInput() textarea.Model {
+	input := textarea.New()
+	input.Placeholder = "Token, URL, stack trace..."
+	input.ShowLineNumbers = false
+	input.CharLimit = 0
+	input.MaxHeight = 0
+	input.Focus()
+	return input
+}